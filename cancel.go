@@ -0,0 +1,100 @@
+package rpcserver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+// ----------------------------------------------------------------------------
+// Cancellation
+// ----------------------------------------------------------------------------
+
+const (
+	// CancelMethod is the notification cancelling a running call, as in
+	// {"method": "$/cancelRequest", "params": {"id": 1}}.
+	CancelMethod = "$/cancelRequest"
+	// SessionHeader is the HTTP header with the session of the client.
+	// Calls can only be cancelled within the same session, calls and
+	// cancellations without the header are not matched.
+	SessionHeader = "X-Rpc-Session"
+)
+
+// CancelParams are the params of CancelMethod.
+type CancelParams struct {
+	Id json.RawMessage `json:"id"` // id of the call to cancel
+}
+
+// inflightKey identifies a running call.
+type inflightKey struct {
+	session string // SessionHeader of the request
+	id      string // request id
+}
+
+// inflightCall is a running call which can be cancelled.
+type inflightCall struct {
+	cancel context.CancelFunc
+}
+
+// inflight is the registry of the running calls with an id.
+type inflight struct {
+	mu    sync.Mutex
+	calls map[inflightKey]*inflightCall
+}
+
+// add registers the call and returns its context and the function removing
+// the call once it is done.
+func (in *inflight) add(ctx context.Context, key inflightKey) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	call := &inflightCall{cancel: cancel}
+	in.mu.Lock()
+	if in.calls == nil {
+		in.calls = make(map[inflightKey]*inflightCall)
+	}
+	in.calls[key] = call
+	in.mu.Unlock()
+	return ctx, func() {
+		in.mu.Lock()
+		if in.calls[key] == call {
+			delete(in.calls, key)
+		}
+		in.mu.Unlock()
+		cancel()
+	}
+}
+
+// cancel cancels the running call, it returns false if there is none.
+func (in *inflight) cancel(key inflightKey) bool {
+	in.mu.Lock()
+	call := in.calls[key]
+	in.mu.Unlock()
+	if call == nil {
+		return false
+	}
+	call.cancel()
+	return true
+}
+
+// serveCancel cancels the call given by the params of the request.
+//
+// Unknown or finished calls are ignored, as the cancellation can come late,
+// as are cancellations without SessionHeader. A cancellation sent as a request
+// with an id gets a null result.
+func (s *Server) serveCancel(w http.ResponseWriter, r *http.Request, codecReq CodecRequest) {
+	params := &CancelParams{}
+	if errRead := codecReq.ReadRequest(params); errRead != nil {
+		s.writeError(w, codecReq, errRead)
+		return
+	}
+	if session := r.Header.Get(SessionHeader); session != "" {
+		s.inflight.cancel(inflightKey{session: session, id: string(params.Id)})
+	}
+	codecReq.WriteResponse(w, nil)
+}
+
+// errCancelled is returned for calls cancelled by the client.
+var errCancelled = &Error{
+	Code:    CodeRequestCancelled,
+	Message: "rpc: request cancelled",
+}
@@ -18,12 +18,31 @@ type Codec interface {
 type CodecRequest interface {
 	// Shows if request was valid or incorrect. Check this after CodecRequest was created.
 	Error() error
+	// Returns the request id, empty for notifications.
+	Id() string
+	// Shows if request is a notification which never gets a response.
+	IsNotification() bool
 	// Reads the request and returns the RPC method name.
 	Method() (string, error)
 	// Reads the request filling the RPC method args.
 	ReadRequest(interface{}) error
 	// Writes the response using the RPC method reply.
 	WriteResponse(http.ResponseWriter, interface{})
-	// Writes an error produced by the server.
+	// Writes an error produced by the server with the given HTTP status.
+	// The error code is not related to the status, see ErrorCode.
 	WriteError(w http.ResponseWriter, status int, err error)
 }
+
+// BatchCodecRequest is an optional interface implemented by a CodecRequest
+// that can carry several requests in one HTTP body.
+type BatchCodecRequest interface {
+	CodecRequest
+	// Shows if request is a batch. Check this after CodecRequest was created.
+	IsBatch() bool
+	// Returns the requests of the batch. Their responses are collected by the
+	// batch instead of being written to the http.ResponseWriter. Requests may
+	// be served concurrently.
+	Requests() []CodecRequest
+	// Writes the collected responses of the batch.
+	WriteBatch(http.ResponseWriter)
+}
@@ -0,0 +1,46 @@
+package rpcserver
+
+import (
+	"context"
+	"net/http"
+)
+
+// ----------------------------------------------------------------------------
+// Context
+// ----------------------------------------------------------------------------
+
+type contextKey int
+
+const (
+	requestKey contextKey = iota
+	idKey
+	methodKey
+)
+
+// newContext returns a copy of ctx carrying the details of the call.
+func newContext(ctx context.Context, r *http.Request, id string, method string) context.Context {
+	ctx = context.WithValue(ctx, requestKey, r)
+	ctx = context.WithValue(ctx, idKey, id)
+	ctx = context.WithValue(ctx, methodKey, method)
+	return ctx
+}
+
+// RequestFromContext returns the HTTP request of the call, nil if unknown.
+func RequestFromContext(ctx context.Context) *http.Request {
+	r, _ := ctx.Value(requestKey).(*http.Request)
+	return r
+}
+
+// IdFromContext returns the request id of the call as it was sent by the
+// client, empty for notifications.
+func IdFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(idKey).(string)
+	return id
+}
+
+// MethodFromContext returns the method name of the call as it was sent by
+// the client, e.g. "Service.Method".
+func MethodFromContext(ctx context.Context) string {
+	method, _ := ctx.Value(methodKey).(string)
+	return method
+}
@@ -0,0 +1,200 @@
+package rpcserver
+
+import (
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+// ----------------------------------------------------------------------------
+// Discover
+// ----------------------------------------------------------------------------
+
+// DiscoverMethod returns the OpenRPC document of the server.
+const DiscoverMethod = "rpc.discover"
+
+// OpenRPCVersion is the version of the OpenRPC specification followed by the
+// document returned by DiscoverMethod.
+const OpenRPCVersion = "1.2.6"
+
+// OpenRPC is the OpenRPC document describing the methods of the server,
+// see https://spec.open-rpc.org
+type OpenRPC struct {
+	OpenRPC string           `json:"openrpc"`
+	Info    OpenRPCInfo      `json:"info"`
+	Methods []*OpenRPCMethod `json:"methods"`
+}
+
+// OpenRPCInfo is the metadata of the API.
+type OpenRPCInfo struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Version     string `json:"version"`
+}
+
+// OpenRPCMethod describes a method.
+type OpenRPCMethod struct {
+	Name           string               `json:"name"`
+	Summary        string               `json:"summary,omitempty"`
+	Description    string               `json:"description,omitempty"`
+	ParamStructure string               `json:"paramStructure,omitempty"`
+	Params         []*ContentDescriptor `json:"params"`
+	Result         *ContentDescriptor   `json:"result"`
+	Errors         []*MethodError       `json:"errors,omitempty"`
+	Examples       []*MethodExample     `json:"examples,omitempty"`
+	Deprecated     bool                 `json:"deprecated,omitempty"`
+
+	// Extensions published from MethodOptions.
+	Permissions []string `json:"x-permissions,omitempty"`
+	Idempotent  bool     `json:"x-idempotent,omitempty"`
+}
+
+// ContentDescriptor describes a parameter or a result.
+type ContentDescriptor struct {
+	Name     string  `json:"name"`
+	Required bool    `json:"required,omitempty"`
+	Schema   *Schema `json:"schema"`
+}
+
+// MethodError is an error the method may return.
+type MethodError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// MethodExample is an example of a call of the method.
+type MethodExample struct {
+	Name   string          `json:"name"`
+	Params []*ExampleValue `json:"params"`
+	Result *ExampleValue   `json:"result"`
+}
+
+// ExampleValue is an example of a parameter or a result.
+type ExampleValue struct {
+	Name  string      `json:"name"`
+	Value interface{} `json:"value"`
+}
+
+// MethodDoc is the documentation of a method published by DiscoverMethod.
+type MethodDoc struct {
+	Summary     string
+	Description string
+	Errors      []*MethodError
+	Examples    []*MethodExample
+}
+
+// SetInfo sets the metadata of the API published by DiscoverMethod.
+func (s *Server) SetInfo(info OpenRPCInfo) {
+	s.info = info
+}
+
+// Describe sets the documentation of the method published by DiscoverMethod,
+// see NameMapper for the name of the method.
+func (s *Server) Describe(method string, doc *MethodDoc) error {
+	return s.updateMethod(method, func(methodSpec *RpcServiceMethod) error {
+		methodSpec.doc = doc
+		return nil
+	})
+}
+
+// Discover returns the OpenRPC document of the registered methods.
+func (s *Server) Discover() *OpenRPC {
+	doc := &OpenRPC{
+		OpenRPC: OpenRPCVersion,
+		Info:    s.info,
+		Methods: make([]*OpenRPCMethod, 0),
+	}
+	for name, ref := range s.registry.Load().names {
+		if name != ref.name {
+			continue // alias
+		}
+		if ref.method.options != nil && ref.method.options.Hidden {
+			continue
+		}
+		doc.Methods = append(doc.Methods, ref.method.describe(name))
+	}
+	sort.Slice(doc.Methods, func(i, j int) bool {
+		return doc.Methods[i].Name < doc.Methods[j].Name
+	})
+	return doc
+}
+
+// serveDiscover writes the OpenRPC document of the server.
+func (s *Server) serveDiscover(w http.ResponseWriter, codecReq CodecRequest) {
+	codecReq.WriteResponse(w, s.Discover())
+}
+
+// describe returns the OpenRPC description of the method.
+func (m *RpcServiceMethod) describe(name string) *OpenRPCMethod {
+	method := &OpenRPCMethod{
+		Name: name,
+		Result: &ContentDescriptor{
+			Name:   "result",
+			Schema: SchemaOf(m.replyType),
+		},
+	}
+	if m.doc != nil {
+		method.Summary = m.doc.Summary
+		method.Description = m.doc.Description
+		method.Errors = m.doc.Errors
+		method.Examples = m.doc.Examples
+	}
+	if m.options != nil {
+		if method.Description == "" {
+			method.Description = m.options.Description
+		}
+		method.Deprecated = m.options.Deprecated
+		method.Permissions = m.options.Permissions
+		method.Idempotent = m.options.Idempotent
+	}
+	switch {
+	case m.paramTypes != nil:
+		// Several parameters, by name only if the names are known.
+		method.ParamStructure = "by-position"
+		if m.paramNames != nil {
+			method.ParamStructure = "either"
+		}
+		for i, t := range m.paramTypes {
+			param := &ContentDescriptor{Schema: SchemaOf(t)}
+			if m.paramNames != nil {
+				param.Name = m.paramNames[i]
+			} else {
+				param.Name = "param" + strconv.Itoa(i)
+			}
+			method.Params = append(method.Params, param)
+		}
+	case m.argsType.Kind() == reflect.Struct:
+		// Struct fields are the params by name.
+		method.ParamStructure = "by-name"
+		schema := SchemaOf(m.argsType)
+		required := make(map[string]bool)
+		for _, name := range schema.Required {
+			required[name] = true
+		}
+		names := make([]string, 0, len(schema.Properties))
+		for name := range schema.Properties {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			method.Params = append(method.Params, &ContentDescriptor{
+				Name:     name,
+				Required: required[name],
+				Schema:   schema.Properties[name],
+			})
+		}
+	default:
+		method.ParamStructure = "by-position"
+		method.Params = []*ContentDescriptor{{
+			Name:     "args",
+			Required: true,
+			Schema:   SchemaOf(m.argsType),
+		}}
+	}
+	if method.Params == nil {
+		method.Params = make([]*ContentDescriptor, 0)
+	}
+	return method
+}
@@ -0,0 +1,254 @@
+package rpcserver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+)
+
+// ----------------------------------------------------------------------------
+// Errors
+// ----------------------------------------------------------------------------
+
+// Error codes defined by JSON-RPC 2.0 which are produced by the server.
+const (
+	CodeParseError     = -32700
+	CodeInvalidRequest = -32600
+	CodeMethodNotFound = -32601
+	CodeInvalidParams  = -32602
+	CodeInternalError  = -32603
+	CodeServerError    = -32000
+	CodeTimeout        = -32001 // implementation-defined
+	CodeLimitExceeded  = -32002 // implementation-defined, request too large
+
+	// Implementation-defined codes of calls denied by the MethodOptions.
+	CodePermissionDenied = -32003
+	CodeRateLimited      = -32004
+
+	// Implementation-defined code of requests received during Shutdown.
+	CodeShuttingDown = -32005
+
+	// The code of cancelled requests, as in the Language Server Protocol.
+	CodeRequestCancelled = -32800
+)
+
+// ErrorCoder is implemented by errors which carry an error code.
+type ErrorCoder interface {
+	ErrorCode() int
+}
+
+// Error is an error with a code produced by the server.
+type Error struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// ErrorCode returns the code of the error.
+func (e *Error) ErrorCode() int {
+	return e.Code
+}
+
+// ErrorDataer is implemented by errors which carry structured data for the
+// client, e.g. the fields which failed validation.
+type ErrorDataer interface {
+	ErrorData() interface{}
+}
+
+// ErrorCode returns the code of the first error in the chain implementing
+// ErrorCoder, CodeServerError if there is none.
+func ErrorCode(err error) int {
+	var coder ErrorCoder
+	if errors.As(err, &coder) {
+		return coder.ErrorCode()
+	}
+	return CodeServerError
+}
+
+// ----------------------------------------------------------------------------
+// Error mapping
+// ----------------------------------------------------------------------------
+
+// errorMapping returns the code for the errors it matches.
+type errorMapping func(err error) (int, bool)
+
+// MapError sets the code sent for errors matching target with errors.Is.
+//
+// Codes from -32000 to -32099 are reserved for implementation-defined
+// server errors, codes out of -32768..-32000 are free for the application.
+// Mappings are checked in the order they were added.
+func (s *Server) MapError(target error, code int) {
+	s.errorMappings = append(s.errorMappings, func(err error) (int, bool) {
+		return code, errors.Is(err, target)
+	})
+}
+
+// MapErrorType sets the code sent for errors matching type E with errors.As,
+// see MapError.
+func MapErrorType[E error](s *Server, code int) {
+	s.errorMappings = append(s.errorMappings, func(err error) (int, bool) {
+		var target E
+		return code, errors.As(err, &target)
+	})
+}
+
+// mappedCode returns the code of the first mapping matching the error.
+func (s *Server) mappedCode(err error) (int, bool) {
+	for _, mapping := range s.errorMappings {
+		if code, mapped := mapping(err); mapped {
+			return code, true
+		}
+	}
+	return 0, false
+}
+
+// mapError converts an error returned by a call to *Error if it matches a
+// mapping or carries data, see ErrorDataer. Other errors are kept as is.
+func (s *Server) mapError(err error) error {
+	code, mapped := s.mappedCode(err)
+	var dataer ErrorDataer
+	hasData := errors.As(err, &dataer)
+	if !mapped && !hasData {
+		return err
+	}
+	if !mapped {
+		code = ErrorCode(err)
+	}
+	rpcErr := &Error{
+		Code:    code,
+		Message: err.Error(),
+	}
+	if hasData {
+		rpcErr.Data = dataer.ErrorData()
+	}
+	return rpcErr
+}
+
+// ----------------------------------------------------------------------------
+// ErrorMode
+// ----------------------------------------------------------------------------
+
+// ErrorMode tells how errors without a code are sent to the client.
+//
+// Errors with a code, see ErrorCode and MapError, are always sent as is.
+// Others, including panics, are unexpected and may leak internal details.
+type ErrorMode int
+
+const (
+	// ErrorsAsIs sends the message of the error. Panics are still reported
+	// by codecs without the details. It is the default mode.
+	ErrorsAsIs ErrorMode = iota
+	// ErrorsProduction replaces the error with a generic internal error
+	// carrying a correlation id. The original error is logged with the id.
+	ErrorsProduction
+	// ErrorsDebug sends an internal error with the message of the error,
+	// the messages of the wrapped errors and for panics the stack trace.
+	ErrorsDebug
+)
+
+// InternalErrorData is the data of the internal errors made by ErrorMode.
+type InternalErrorData struct {
+	CorrelationId string   `json:"correlationId"`
+	Chain         []string `json:"chain,omitempty"` // messages of the wrapped errors
+	Stack         string   `json:"stack,omitempty"` // stack trace of a panic
+}
+
+// SetErrorMode sets how errors without a code are sent to the client.
+func (s *Server) SetErrorMode(mode ErrorMode) {
+	s.errorMode = mode
+}
+
+// sanitizeError converts an error returned by a call of the method with
+// mapError, or according to the error mode if it has no code.
+//
+// An error has a code if it matches a mapping or implements ErrorCoder. Data
+// alone doesn't make it safe to send, see ErrorDataer.
+func (s *Server) sanitizeError(method string, err error) error {
+	if s.errorMode == ErrorsAsIs {
+		return s.mapError(err)
+	}
+	panicErr, isPanic := err.(*PanicError)
+	var coder ErrorCoder
+	if _, mapped := s.mappedCode(err); mapped || !isPanic && errors.As(err, &coder) {
+		return s.mapError(err)
+	}
+	data := &InternalErrorData{
+		CorrelationId: newCorrelationId(),
+	}
+	if s.errorMode == ErrorsProduction {
+		log.Printf("rpc: internal error %s in %q: %v", data.CorrelationId, method, err)
+		return &Error{
+			Code:    CodeInternalError,
+			Message: "internal error",
+			Data:    data,
+		}
+	}
+	for wrapped := errors.Unwrap(err); wrapped != nil; wrapped = errors.Unwrap(wrapped) {
+		data.Chain = append(data.Chain, wrapped.Error())
+	}
+	if isPanic {
+		data.Stack = string(panicErr.Stack)
+	}
+	return &Error{
+		Code:    CodeInternalError,
+		Message: err.Error(),
+		Data:    data,
+	}
+}
+
+// newCorrelationId returns a random id to find the error in the logs.
+func newCorrelationId() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// ----------------------------------------------------------------------------
+// StatusPolicy
+// ----------------------------------------------------------------------------
+
+// StatusPolicy returns the HTTP status of a response with the error code.
+//
+// It is used for single requests only, a batch is always answered with 200.
+type StatusPolicy func(code int) int
+
+// StatusAlways200 answers all errors with 200 OK, as in strict JSON-RPC over
+// HTTP. It is the default policy.
+func StatusAlways200(code int) int {
+	return http.StatusOK
+}
+
+// StatusREST answers errors produced by the server with the matching
+// HTTP status. Other errors are answered with 200 OK.
+func StatusREST(code int) int {
+	switch code {
+	case CodeParseError, CodeInvalidRequest, CodeInvalidParams:
+		return http.StatusBadRequest
+	case CodeMethodNotFound:
+		return http.StatusNotFound
+	case CodeInternalError:
+		return http.StatusInternalServerError
+	case CodeTimeout:
+		return http.StatusGatewayTimeout
+	case CodeLimitExceeded:
+		return http.StatusRequestEntityTooLarge
+	case CodePermissionDenied:
+		return http.StatusForbidden
+	case CodeRateLimited:
+		return http.StatusTooManyRequests
+	case CodeShuttingDown:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusOK
+}
+
+// SetStatusPolicy sets the policy choosing the HTTP status of errors.
+func (s *Server) SetStatusPolicy(policy StatusPolicy) {
+	s.statusPolicy = policy
+}
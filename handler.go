@@ -0,0 +1,60 @@
+package rpcserver
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+)
+
+// ----------------------------------------------------------------------------
+// Handler
+// ----------------------------------------------------------------------------
+
+// Handle registers a function as the RPC method with the given name.
+//
+// The method is given as "Service.Method" whatever the NameMapper, names
+// without a dot go to the default service. Clients call it, and the other
+// settings take it, by the name made by the mapper set with SetNameMapper.
+// The service is created if needed, the method must not be registered yet
+// and the validate tags of the args must be well formed.
+//
+// Unlike the methods of a receiver, fn is called directly without reflection
+// and may be any func or closure.
+func Handle[Args, Reply any](s *Server, method string, fn func(context.Context, *Args) (*Reply, error)) error {
+	serviceName, methodName := splitMethod(method)
+	if methodName == "" {
+		return fmt.Errorf("rpc: method name empty in %q", method)
+	}
+	methodSpec := &RpcServiceMethod{
+		argsType:     reflect.TypeOf((*Args)(nil)).Elem(),
+		replyType:    reflect.TypeOf((*Reply)(nil)).Elem(),
+		withContext:  true,
+		returnsReply: true,
+		handler: func(ctx context.Context, args interface{}) (interface{}, error) {
+			return fn(ctx, args.(*Args))
+		},
+		newArgs: func() interface{} {
+			return new(Args)
+		},
+	}
+	if err := methodSpec.parseRules(); err != nil {
+		return fmt.Errorf("rpc: method %q: %v", method, err)
+	}
+	return s.update(func(reg *registry) error {
+		service := reg.services[serviceName]
+		if service == nil {
+			service = &RpcService{
+				name:    serviceName,
+				methods: make(map[string]*RpcServiceMethod),
+			}
+		} else {
+			service = service.clone()
+		}
+		if _, ok := service.methods[methodName]; ok {
+			return fmt.Errorf("rpc: method already defined: %q", method)
+		}
+		service.methods[methodName] = methodSpec
+		reg.services[serviceName] = service
+		return nil
+	})
+}
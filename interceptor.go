@@ -0,0 +1,83 @@
+package rpcserver
+
+import (
+	"context"
+	"net/http"
+	"runtime/debug"
+)
+
+// ----------------------------------------------------------------------------
+// Interceptor
+// ----------------------------------------------------------------------------
+
+// Call describes a call of a service method.
+type Call struct {
+	Method  string        // method name as sent by the client
+	Args    interface{}   // decoded args, see RpcServiceMethod.Args
+	Request *http.Request // HTTP request carrying the call
+}
+
+// Invoker calls the service method, or the next interceptor in the chain.
+type Invoker func(ctx context.Context, call *Call) (interface{}, error)
+
+// Interceptor runs around the call of a service method.
+//
+// It may call next to proceed, possibly with a derived context or changed
+// args, and may inspect or replace the returned reply and error. Returning
+// without calling next short-circuits the call; the error is sent to the
+// client as usual, so it can be a codec specific error like *jsonrpc2.Error.
+type Interceptor func(ctx context.Context, call *Call, next Invoker) (interface{}, error)
+
+// Use adds interceptors for all methods of the server.
+//
+// Interceptors run in the order they were added, the ones added with
+// UseFor run after them.
+func (s *Server) Use(interceptors ...Interceptor) {
+	s.interceptors = append(s.interceptors, interceptors...)
+}
+
+// UseFor adds interceptors for a single method, given by a name as described
+// by NameMapper.
+func (s *Server) UseFor(method string, interceptors ...Interceptor) error {
+	return s.updateMethod(method, func(methodSpec *RpcServiceMethod) error {
+		// A new slice, the old one is used by the running calls.
+		methodSpec.interceptors = append(append([]Interceptor(nil), methodSpec.interceptors...), interceptors...)
+		return nil
+	})
+}
+
+// invoke calls the service method through the chain of interceptors.
+//
+// Panics are recovered and returned as *PanicError.
+func (s *Server) invoke(ctx context.Context, call *Call, service *RpcService, methodSpec *RpcServiceMethod) (reply interface{}, err error) {
+	defer func() {
+		if value := recover(); value != nil {
+			panicErr := &PanicError{Value: value, Stack: debug.Stack()}
+			if s.panicHandler != nil {
+				s.panicHandler(ctx, call, panicErr)
+			}
+			reply, err = nil, panicErr
+		}
+	}()
+	invoker := func(ctx context.Context, call *Call) (interface{}, error) {
+		r := call.Request
+		if ctx != r.Context() {
+			r = r.WithContext(ctx)
+		}
+		return methodSpec.call(service.rcvr, r, ctx, call.Args)
+	}
+	invoker = chain(invoker, methodSpec.interceptors)
+	invoker = chain(invoker, s.interceptors)
+	return invoker(ctx, call)
+}
+
+// chain wraps the invoker so the first interceptor runs first.
+func chain(invoker Invoker, interceptors []Interceptor) Invoker {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], invoker
+		invoker = func(ctx context.Context, call *Call) (interface{}, error) {
+			return interceptor(ctx, call, next)
+		}
+	}
+	return invoker
+}
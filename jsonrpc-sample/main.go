@@ -1,12 +1,17 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"github.com/datalinkE/rpcserver"
 	"github.com/datalinkE/rpcserver/jsonrpc2"
 	"gopkg.in/gin-gonic/gin.v1"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 type Args struct {
@@ -19,7 +24,7 @@ type Quotient struct {
 
 type Arith int
 
-func (t *Arith) Multiply(r *http.Request, args *Args, reply *int) error {
+func (t *Arith) Multiply(ctx context.Context, args *Args, reply *int) error {
 	log.Print("multiply")
 	*reply = args.A * args.B
 	return nil
@@ -43,10 +48,32 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	if err := anotherServer.RegisterService(arith, ""); err != nil {
+		log.Fatal(err)
+	}
 	anotherServer.RegisterCodec(jsonrpc2.NewCodec(), "application/json")
 
 	router := gin.Default()
 	router.POST("/jsonrpc/v2/:method", gin.WrapH(anotherServer))
 
-	log.Fatal(router.Run())
+	httpServer := &http.Server{Addr: ":8080", Handler: router}
+	go func() {
+		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	// Let the running calls finish before exit.
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+	log.Print("shutdown")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := anotherServer.Shutdown(ctx); err != nil {
+		log.Print(err)
+	}
+	if err := httpServer.Shutdown(ctx); err != nil {
+		log.Print(err)
+	}
 }
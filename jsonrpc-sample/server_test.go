@@ -1,7 +1,10 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/datalinkE/rpcserver"
 	"github.com/datalinkE/rpcserver/jsonrpc2"
 	"github.com/gin-gonic/gin"
@@ -9,8 +12,12 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func ShowResponse(t *testing.T, w *httptest.ResponseRecorder) string {
@@ -27,10 +34,17 @@ func ShowResponse(t *testing.T, w *httptest.ResponseRecorder) string {
 }
 
 func performRequest(t *testing.T, getOrPost string, path string, body string) (*MockRpcObject, *httptest.ResponseRecorder) {
+	return performRequestWith(t, nil, getOrPost, path, body)
+}
+
+func performRequestWith(t *testing.T, setup func(*rpcserver.Server), getOrPost string, path string, body string) (*MockRpcObject, *httptest.ResponseRecorder) {
 	mock := NewMockRpcObject(t)
 	server, err := rpcserver.NewServer(mock)
 	require.NoError(t, err)
 	server.RegisterCodec(jsonrpc2.NewCodec(), "application/json")
+	if setup != nil {
+		setup(server)
+	}
 	gin.SetMode(gin.ReleaseMode)
 	engine := gin.New()
 	engine.POST("/jsonrpc/v1/:method", gin.WrapH(server))
@@ -161,6 +175,1413 @@ func Test_09_NotifyRequestHaveResponseByDefault(t *testing.T) { // Notify reques
 	require.NoError(t, mock.Err)
 }
 
+func respectNotify(server *rpcserver.Server) {
+	codec := jsonrpc2.NewCodec()
+	codec.RespectNotifyMessages = true
+	server.RegisterCodec(codec, "application/json")
+}
+
+func Test_09_NotifyRequestNoContent(t *testing.T) {
+	mock, w := performRequestWith(t, respectNotify, "POST", "/jsonrpc/v1/Action", `{"jsonrpc": "2.0", "method": "Action", "params": {"A": 5, "B": 2}}`)
+
+	body := ShowResponse(t, w)
+
+	require.Equal(t, 204, w.Code)
+	require.Equal(t, "", body)
+	require.Equal(t, 1, mock.Called)
+	require.Equal(t, 3, mock.Result)
+}
+
+func Test_09_NotifyRequestErrorSwallowed(t *testing.T) {
+	mock, w := performRequestWith(t, respectNotify, "POST", "/jsonrpc/v1/Action", `{"jsonrpc": "2.0", "method": "Action", "params": {"A": 5, "B": 5}}`)
+
+	body := ShowResponse(t, w)
+
+	require.Equal(t, 204, w.Code)
+	require.Equal(t, "", body)
+	require.Equal(t, 1, mock.Called)
+	require.Error(t, mock.Err)
+}
+
+func Test_09_NotifyRequestInvalidHaveResponse(t *testing.T) {
+	mock, w := performRequestWith(t, respectNotify, "POST", "/jsonrpc/v1/Action", `{"method": "Action", "params": {"A": 5, "B": 2}}`)
+
+	body := ShowResponse(t, w)
+
+	require.Equal(t, 200, w.Code)
+	require.True(t, strings.Contains(body, `"code":-32600`))
+	require.Equal(t, 0, mock.Called)
+}
+
+func Test_09_NotifyRequestAsync(t *testing.T) {
+	release := make(chan struct{})
+	done := make(chan error)
+	setup := func(server *rpcserver.Server) {
+		respectNotify(server)
+		server.SetAsyncNotifications(true)
+		err := rpcserver.Handle(server, "Notify", func(ctx context.Context, args *MockArgs) (*MockReply, error) {
+			<-release
+			done <- ctx.Err()
+			return nil, nil
+		})
+		require.NoError(t, err)
+	}
+	_, w := performRequestWith(t, setup, "POST", "/jsonrpc/v1/Notify", `{"jsonrpc": "2.0", "method": "Notify", "params": {"A": 5, "B": 2}}`)
+
+	require.Equal(t, 204, w.Code) // before the handler is done
+	close(release)
+	select {
+	case err := <-done:
+		require.NoError(t, err) // not cancelled with the request
+	case <-time.After(time.Second):
+		t.Fatal("notification was not called")
+	}
+}
+
+func Test_10_RegisterService(t *testing.T) {
+	mock := NewMockRpcObject(t)
+	server, err := rpcserver.NewServer(nil)
+	require.NoError(t, err)
+	require.NoError(t, server.RegisterService(mock, ""))
+	require.NoError(t, server.RegisterService(mock, "Mock"))
+	require.Error(t, server.RegisterService(mock, "Mock")) // duplicate name
+	server.RegisterCodec(jsonrpc2.NewCodec(), "application/json")
+
+	require.True(t, server.HasMethod("MockRpcObject.Action"))
+	require.True(t, server.HasMethod("Mock.Action"))
+	require.False(t, server.HasMethod("Action")) // no default service
+	require.False(t, server.HasMethod("Wrong.Action"))
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/jsonrpc/v1/Mock.Action", strings.NewReader(`{"jsonrpc": "2.0", "method": "Mock.Action", "id":1, "params": {"A": 5, "B": 2}}`))
+	server.ServeHTTP(w, req)
+	body := ShowResponse(t, w)
+
+	require.Equal(t, 200, w.Code)
+	require.True(t, strings.Contains(body, `"result":{"Value":3}`))
+	require.Equal(t, 1, mock.Called)
+}
+
+func Test_11_Batch(t *testing.T) {
+	mock, w := performRequest(t, "POST", "/jsonrpc/v1/Action", `[
+		{"jsonrpc": "2.0", "method": "Action", "id":1, "params": {"A": 5, "B": 2}},
+		{"jsonrpc": "2.0", "method": "Action", "params": {"A": 7, "B": 2}},
+		{"jsonrpc": "2.0", "method": "Action", "id":"two", "params": {"A": 5, "B": 5}},
+		1
+	]`)
+
+	body := ShowResponse(t, w)
+
+	require.Equal(t, 200, w.Code)
+	require.JSONEq(t, `[
+		{"jsonrpc":"2.0","result":{"Value":3},"id":1},
+		{"jsonrpc":"2.0","error":{"code":-32000,"message":"expected error A==B - simple"},"id":"two"},
+		{"jsonrpc":"2.0","error":{"code":-32600,"message":"json: cannot unmarshal number into Go value of type jsonrpc2.serverRequest"}}
+	]`, body)
+	require.Equal(t, 3, mock.Called)
+}
+
+func Test_11_BatchOfNotifications(t *testing.T) {
+	mock, w := performRequest(t, "POST", "/jsonrpc/v1/Action", `[
+		{"jsonrpc": "2.0", "method": "Action", "params": {"A": 5, "B": 2}},
+		{"jsonrpc": "2.0", "method": "Action", "params": {"A": 7, "B": 2}}
+	]`)
+
+	body := ShowResponse(t, w)
+
+	require.Equal(t, 204, w.Code)
+	require.Equal(t, "", body) // nothing at all
+	require.Equal(t, 2, mock.Called)
+}
+
+func Test_11_EmptyBatch(t *testing.T) {
+	mock, w := performRequest(t, "POST", "/jsonrpc/v1/Action", `[]`)
+
+	body := ShowResponse(t, w)
+
+	require.Equal(t, 200, w.Code)
+	require.True(t, strings.HasPrefix(body, `{"jsonrpc":"2.0","error":{"code":-32600`)) // single response
+	require.Equal(t, 0, mock.Called)
+}
+
+func performSlowBatch(t *testing.T, workers int, sequential bool) (*MockSlowObject, string) {
+	slow := &MockSlowObject{}
+	server, err := rpcserver.NewServer(nil)
+	require.NoError(t, err)
+	require.NoError(t, server.RegisterService(slow, "Slow"))
+	require.NoError(t, server.SetSequential("Slow", sequential))
+	server.SetBatchWorkers(workers)
+	server.RegisterCodec(jsonrpc2.NewCodec(), "application/json")
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/jsonrpc/v1/Slow.Sleep", strings.NewReader(`[
+		{"jsonrpc": "2.0", "method": "Slow.Sleep", "id":1, "params": {"A": 1}},
+		{"jsonrpc": "2.0", "method": "Slow.Sleep", "id":2, "params": {"A": 2}},
+		{"jsonrpc": "2.0", "method": "Slow.Sleep", "id":3, "params": {"A": 3}},
+		{"jsonrpc": "2.0", "method": "Slow.Sleep", "id":4, "params": {"A": 4}}
+	]`))
+	server.ServeHTTP(w, req)
+	body := ShowResponse(t, w)
+	require.Equal(t, 200, w.Code)
+	return slow, body
+}
+
+func Test_12_BatchWorkers(t *testing.T) {
+	slow, body := performSlowBatch(t, 2, false)
+
+	require.Equal(t, int32(2), slow.MaxRunning)
+	require.JSONEq(t, `[
+		{"jsonrpc":"2.0","result":{"Value":1},"id":1},
+		{"jsonrpc":"2.0","result":{"Value":2},"id":2},
+		{"jsonrpc":"2.0","result":{"Value":3},"id":3},
+		{"jsonrpc":"2.0","result":{"Value":4},"id":4}
+	]`, body)
+}
+
+func Test_12_BatchSequentialService(t *testing.T) {
+	slow, body := performSlowBatch(t, 4, true)
+
+	require.Equal(t, int32(1), slow.MaxRunning)
+	require.Equal(t, []int{1, 2, 3, 4}, slow.Order)
+	require.True(t, strings.Contains(body, `"result":{"Value":4},"id":4`))
+}
+
+func Test_13_ContextMethod(t *testing.T) {
+	mock, w := performRequest(t, "POST", "/jsonrpc/v1/ActionContext", `{"jsonrpc": "2.0", "method": "ActionContext", "id":"abc", "params": {"A": 5, "B": 2}}`)
+
+	body := ShowResponse(t, w)
+
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, `{"jsonrpc":"2.0","result":{"Value":3},"id":"abc"}`+"\n", body)
+	require.Equal(t, 1, mock.Called)
+	require.Equal(t, `"abc"`, mock.Id)
+	require.Equal(t, "ActionContext", mock.Method)
+}
+
+func Test_14_ReturnReply(t *testing.T) {
+	mock, w := performRequest(t, "POST", "/jsonrpc/v1/ActionReturn", `{"jsonrpc": "2.0", "method": "ActionReturn", "id":1, "params": {"A": 5, "B": 2}}`)
+	body := ShowResponse(t, w)
+	require.Equal(t, `{"jsonrpc":"2.0","result":{"Value":3},"id":1}`+"\n", body)
+	require.Equal(t, 1, mock.Called)
+
+	mock, w = performRequest(t, "POST", "/jsonrpc/v1/ActionReturnPtr", `{"jsonrpc": "2.0", "method": "ActionReturnPtr", "id":1, "params": {"A": 5, "B": 5}}`)
+	body = ShowResponse(t, w)
+	require.True(t, strings.Contains(body, `"message":"expected error A==B - simple"`))
+	require.Equal(t, 1, mock.Called)
+}
+
+func Test_15_Handle(t *testing.T) {
+	server, err := rpcserver.NewServer(NewMockRpcObject(t))
+	require.NoError(t, err)
+	server.RegisterCodec(jsonrpc2.NewCodec(), "application/json")
+	called := 0
+	err = rpcserver.Handle(server, "Calc.Sub", func(ctx context.Context, args *MockArgs) (*MockReply, error) {
+		called++
+		return &MockReply{Value: args.A - args.B}, nil
+	})
+	require.NoError(t, err)
+	err = rpcserver.Handle(server, "Calc.Sub", func(ctx context.Context, args *MockArgs) (*MockReply, error) {
+		return nil, nil
+	})
+	require.Error(t, err) // duplicate method
+	require.True(t, server.HasMethod("Calc.Sub"))
+	require.True(t, server.HasMethod("Action"))
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/jsonrpc/v1/Calc.Sub", strings.NewReader(`{"jsonrpc": "2.0", "method": "Calc.Sub", "id":1, "params": {"A": 5, "B": 2}}`))
+	server.ServeHTTP(w, req)
+	body := ShowResponse(t, w)
+
+	require.Equal(t, `{"jsonrpc":"2.0","result":{"Value":3},"id":1}`+"\n", body)
+	require.Equal(t, 1, called)
+}
+
+func Test_16_SeveralParams(t *testing.T) {
+	paramNames := func(server *rpcserver.Server) {
+		require.NoError(t, server.SetParamNames("ActionParams", "name", "count", "flag"))
+	}
+	_, w := performRequestWith(t, paramNames, "POST", "/jsonrpc/v1/ActionParams", `{"jsonrpc": "2.0", "method": "ActionParams", "id":1, "params": ["a", 5, true]}`)
+	body := ShowResponse(t, w)
+	require.True(t, strings.Contains(body, `"result":"a 5 true"`))
+
+	_, w = performRequestWith(t, paramNames, "POST", "/jsonrpc/v1/ActionParams", `{"jsonrpc": "2.0", "method": "ActionParams", "id":1, "params": ["a"]}`) // missing trailing params
+	body = ShowResponse(t, w)
+	require.True(t, strings.Contains(body, `"result":"a 0 false"`))
+
+	_, w = performRequestWith(t, paramNames, "POST", "/jsonrpc/v1/ActionParams", `{"jsonrpc": "2.0", "method": "ActionParams", "id":1, "params": {"count": 7, "name": "b"}}`)
+	body = ShowResponse(t, w)
+	require.True(t, strings.Contains(body, `"result":"b 7 false"`))
+
+	_, w = performRequestWith(t, paramNames, "POST", "/jsonrpc/v1/ActionParams", `{"jsonrpc": "2.0", "method": "ActionParams", "id":1, "params": ["a", "5"]}`)
+	body = ShowResponse(t, w)
+	require.True(t, strings.Contains(body, `"code":-32602`))
+
+	_, w = performRequestWith(t, paramNames, "POST", "/jsonrpc/v1/ActionParams", `{"jsonrpc": "2.0", "method": "ActionParams", "id":1, "params": ["a", 5, true, 1]}`)
+	body = ShowResponse(t, w)
+	require.True(t, strings.Contains(body, `"code":-32602`))
+
+	// The names must match the parameters of a method with several
+	// parameters.
+	server, err := rpcserver.NewServer(NewMockRpcObject(t))
+	require.NoError(t, err)
+	require.Error(t, server.SetParamNames("ActionParams", "name"))
+	require.Error(t, server.SetParamNames("Action", "args"))
+}
+
+func Test_17_Interceptors(t *testing.T) {
+	var trace []string
+	tracer := func(name string) rpcserver.Interceptor {
+		return func(ctx context.Context, call *rpcserver.Call, next rpcserver.Invoker) (interface{}, error) {
+			trace = append(trace, name+">"+call.Method)
+			reply, err := next(ctx, call)
+			trace = append(trace, name+"<")
+			return reply, err
+		}
+	}
+	setup := func(server *rpcserver.Server) {
+		server.Use(tracer("a"), tracer("b"))
+		require.NoError(t, server.UseFor("Action", tracer("c")))
+		require.Error(t, server.UseFor("Wrong", tracer("c")))
+	}
+	mock, w := performRequestWith(t, setup, "POST", "/jsonrpc/v1/Action", `{"jsonrpc": "2.0", "method": "Action", "id":1, "params": {"A": 5, "B": 2}}`)
+	ShowResponse(t, w)
+
+	require.Equal(t, 1, mock.Called)
+	require.Equal(t, []string{"a>Action", "b>Action", "c>Action", "c<", "b<", "a<"}, trace)
+
+	trace = nil
+	mock, w = performRequestWith(t, setup, "POST", "/jsonrpc/v1/ActionReturn", `{"jsonrpc": "2.0", "method": "ActionReturn", "id":1, "params": {"A": 5, "B": 2}}`)
+	ShowResponse(t, w)
+
+	require.Equal(t, 1, mock.Called)
+	require.Equal(t, []string{"a>ActionReturn", "b>ActionReturn", "b<", "a<"}, trace)
+}
+
+func Test_17_InterceptorShortCircuit(t *testing.T) {
+	setup := func(server *rpcserver.Server) {
+		server.Use(func(ctx context.Context, call *rpcserver.Call, next rpcserver.Invoker) (interface{}, error) {
+			if call.Args.(*MockArgs).A > 100 {
+				return nil, jsonrpc2.NewError(-32001, "denied", nil)
+			}
+			reply, err := next(ctx, call)
+			if err == nil {
+				reply.(*MockReply).Value *= 10 // replace the reply
+			}
+			return reply, err
+		})
+	}
+	mock, w := performRequestWith(t, setup, "POST", "/jsonrpc/v1/Action", `{"jsonrpc": "2.0", "method": "Action", "id":1, "params": {"A": 500, "B": 2}}`)
+	body := ShowResponse(t, w)
+
+	require.Equal(t, 0, mock.Called)
+	require.Equal(t, `{"jsonrpc":"2.0","error":{"code":-32001,"message":"denied"},"id":1}`+"\n", body)
+
+	mock, w = performRequestWith(t, setup, "POST", "/jsonrpc/v1/Action", `{"jsonrpc": "2.0", "method": "Action", "id":1, "params": {"A": 5, "B": 2}}`)
+	body = ShowResponse(t, w)
+
+	require.Equal(t, 1, mock.Called)
+	require.Equal(t, `{"jsonrpc":"2.0","result":{"Value":30},"id":1}`+"\n", body)
+}
+
+func Test_18_PanicRecovered(t *testing.T) {
+	var reported *rpcserver.PanicError
+	setup := func(server *rpcserver.Server) {
+		server.SetBatchWorkers(2)
+		server.SetPanicHandler(func(ctx context.Context, call *rpcserver.Call, err *rpcserver.PanicError) {
+			require.Equal(t, "ActionPanic", call.Method)
+			reported = err
+		})
+	}
+	_, w := performRequestWith(t, setup, "POST", "/jsonrpc/v1/ActionPanic", `{"jsonrpc": "2.0", "method": "ActionPanic", "id":7, "params": {"A": 5, "B": 2}}`)
+	body := ShowResponse(t, w)
+
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, `{"jsonrpc":"2.0","error":{"code":-32603,"message":"internal error"},"id":7}`+"\n", body)
+	require.NotNil(t, reported)
+	require.Equal(t, "expected panic", reported.Value)
+	require.True(t, strings.Contains(string(reported.Stack), "ActionPanic"))
+
+	_, w = performRequestWith(t, setup, "POST", "/jsonrpc/v1/ActionPanic", `[
+		{"jsonrpc": "2.0", "method": "ActionPanic", "id":1, "params": {"A": 5, "B": 2}},
+		{"jsonrpc": "2.0", "method": "ActionPanic", "id":2, "params": {"A": 0, "B": 2}}
+	]`)
+	body = ShowResponse(t, w)
+
+	require.JSONEq(t, `[
+		{"jsonrpc":"2.0","error":{"code":-32603,"message":"internal error"},"id":1},
+		{"jsonrpc":"2.0","result":{"Value":0},"id":2}
+	]`, body)
+}
+
+func Test_19_StatusPolicy(t *testing.T) {
+	_, w := performRequest(t, "POST", "/jsonrpc/v1/Action", `{"jsonrpc": "2.0", "method": "Action", "id":1, "params": {"A": 5, "B": 5}}`)
+	body := ShowResponse(t, w)
+	require.Equal(t, 200, w.Code)
+	require.True(t, strings.Contains(body, `"code":-32000`)) // not the HTTP status
+
+	rest := func(server *rpcserver.Server) {
+		server.SetStatusPolicy(rpcserver.StatusREST)
+	}
+	for _, test := range []struct {
+		path, body string
+		status     int
+		code       string
+	}{
+		{"Action", `{"jsonrpc": "2.0", "method": "Action", "id":1, "params": {"A": 5, "B": 2}}`, 200, ""},
+		{"Action", `{"jsonrpc": "2.0", "method": "Action", "id":1, "params": {"A": 5, "B": 5}}`, 200, `"code":-32000`},
+		{"Action", `{"jsonrpc": "2.0", "method": "Wrong", "id":1}`, 404, `"code":-32601`},
+		{"Action", `{"jsonrpc": "2.0", "method": "Action", "id":1, "params": "wtf"}`, 400, `"code":-32600`},
+		{"Action", `wtf`, 400, `"code":-32700`},
+		{"ActionParams", `{"jsonrpc": "2.0", "method": "ActionParams", "id":1, "params": [1]}`, 400, `"code":-32602`},
+		{"ActionPanic", `{"jsonrpc": "2.0", "method": "ActionPanic", "id":1, "params": {"A": 1}}`, 500, `"code":-32603`},
+	} {
+		_, w := performRequestWith(t, rest, "POST", "/jsonrpc/v1/"+test.path, test.body)
+		body := ShowResponse(t, w)
+		require.Equal(t, test.status, w.Code, test.body)
+		require.True(t, strings.Contains(body, test.code), test.body)
+		require.Equal(t, "application/json; charset=utf-8", w.Header().Get("Content-Type"))
+	}
+}
+
+var ErrMockNotFound = errors.New("not found")
+
+type MockValidationError struct {
+	Field string
+}
+
+func (e *MockValidationError) Error() string {
+	return "invalid " + e.Field
+}
+
+func (e *MockValidationError) ErrorData() interface{} {
+	return map[string]string{"field": e.Field}
+}
+
+func Test_20_ErrorMapping(t *testing.T) {
+	setup := func(server *rpcserver.Server) {
+		server.MapError(ErrMockNotFound, -32004)
+		rpcserver.MapErrorType[*MockValidationError](server, 1001)
+		err := rpcserver.Handle(server, "Fail", func(ctx context.Context, args *MockArgs) (*MockReply, error) {
+			switch args.A {
+			case 1:
+				return nil, fmt.Errorf("user %d: %w", args.B, ErrMockNotFound)
+			case 2:
+				return nil, fmt.Errorf("create: %w", &MockValidationError{Field: "name"})
+			}
+			return nil, errors.New("unmapped")
+		})
+		require.NoError(t, err)
+	}
+	for _, test := range []struct {
+		a        int
+		expected string
+	}{
+		{1, `{"code":-32004,"message":"user 7: not found"}`},
+		{2, `{"code":1001,"message":"create: invalid name","data":{"field":"name"}}`},
+		{3, `{"code":-32000,"message":"unmapped"}`},
+	} {
+		_, w := performRequestWith(t, setup, "POST", "/jsonrpc/v1/Fail", fmt.Sprintf(`{"jsonrpc": "2.0", "method": "Fail", "id":1, "params": {"A": %d, "B": 7}}`, test.a))
+		body := ShowResponse(t, w)
+		require.Equal(t, `{"jsonrpc":"2.0","error":`+test.expected+`,"id":1}`+"\n", body)
+	}
+}
+
+func Test_21_ErrorMode(t *testing.T) {
+	mode := rpcserver.ErrorsProduction
+	setup := func(server *rpcserver.Server) {
+		server.SetErrorMode(mode)
+		server.SetPanicHandler(nil)
+		err := rpcserver.Handle(server, "Fail", func(ctx context.Context, args *MockArgs) (*MockReply, error) {
+			return nil, fmt.Errorf("query: %w", errors.New("connection to 10.0.0.1 refused"))
+		})
+		require.NoError(t, err)
+		err = rpcserver.Handle(server, "FailData", func(ctx context.Context, args *MockArgs) (*MockReply, error) {
+			return nil, &MockValidationError{Field: "password of root"}
+		})
+		require.NoError(t, err)
+	}
+	decode := func(body string) *jsonrpc2.Error {
+		res := struct {
+			Error *jsonrpc2.Error
+		}{}
+		require.NoError(t, json.Unmarshal([]byte(body), &res))
+		require.NotNil(t, res.Error)
+		return res.Error
+	}
+
+	_, w := performRequestWith(t, setup, "POST", "/jsonrpc/v1/Fail", `{"jsonrpc": "2.0", "method": "Fail", "id":1}`)
+	rpcErr := decode(ShowResponse(t, w))
+	require.Equal(t, -32603, rpcErr.Code)
+	require.Equal(t, "internal error", rpcErr.Message)
+	require.Len(t, rpcErr.Data.(map[string]interface{})["correlationId"], 16)
+	require.Nil(t, rpcErr.Data.(map[string]interface{})["chain"])
+
+	// Data doesn't give the error a code.
+	_, w = performRequestWith(t, setup, "POST", "/jsonrpc/v1/FailData", `{"jsonrpc": "2.0", "method": "FailData", "id":1}`)
+	body := ShowResponse(t, w)
+	require.False(t, strings.Contains(body, "password"))
+	rpcErr = decode(body)
+	require.Equal(t, -32603, rpcErr.Code)
+	require.Equal(t, "internal error", rpcErr.Message)
+
+	_, w = performRequestWith(t, setup, "POST", "/jsonrpc/v1/Action", `{"jsonrpc": "2.0", "method": "Action", "id":1, "params": {"A": 10, "B": 1}}`)
+	rpcErr = decode(ShowResponse(t, w))
+	require.Equal(t, 500, rpcErr.Code) // errors with a code are sent as is
+
+	mode = rpcserver.ErrorsDebug
+	_, w = performRequestWith(t, setup, "POST", "/jsonrpc/v1/Fail", `{"jsonrpc": "2.0", "method": "Fail", "id":1}`)
+	rpcErr = decode(ShowResponse(t, w))
+	require.Equal(t, -32603, rpcErr.Code)
+	require.Equal(t, "query: connection to 10.0.0.1 refused", rpcErr.Message)
+	require.Equal(t, []interface{}{"connection to 10.0.0.1 refused"}, rpcErr.Data.(map[string]interface{})["chain"])
+
+	_, w = performRequestWith(t, setup, "POST", "/jsonrpc/v1/ActionPanic", `{"jsonrpc": "2.0", "method": "ActionPanic", "id":1, "params": {"A": 1}}`)
+	rpcErr = decode(ShowResponse(t, w))
+	require.Equal(t, -32603, rpcErr.Code)
+	require.True(t, strings.Contains(rpcErr.Data.(map[string]interface{})["stack"].(string), "ActionPanic"))
+}
+
+func Test_22_Timeout(t *testing.T) {
+	cancelled := make(chan error, 1)
+	wait := func(server *rpcserver.Server) {
+		err := rpcserver.Handle(server, "Wait", func(ctx context.Context, args *MockArgs) (*MockReply, error) {
+			select {
+			case <-ctx.Done():
+				cancelled <- ctx.Err()
+			case <-time.After(time.Duration(args.A) * time.Millisecond):
+				cancelled <- nil
+			}
+			time.Sleep(time.Duration(args.B) * time.Millisecond) // ignoring the context
+			return &MockReply{}, nil
+		})
+		require.NoError(t, err)
+	}
+	request := `{"jsonrpc": "2.0", "method": "Wait", "id":1, "params": {"A": 1000, "B": 1000}}`
+	for _, setup := range []func(*rpcserver.Server){
+		func(s *rpcserver.Server) {
+			wait(s)
+			s.SetTimeout(20 * time.Millisecond)
+		},
+		func(s *rpcserver.Server) {
+			wait(s)
+			s.SetTimeout(time.Hour)
+			require.NoError(t, s.SetMethodTimeout("Wait", 20*time.Millisecond))
+		},
+	} {
+		start := time.Now()
+		_, w := performRequestWith(t, setup, "POST", "/jsonrpc/v1/Wait", request)
+		body := ShowResponse(t, w)
+
+		require.True(t, strings.Contains(body, `"error":{"code":-32001,"message":"rpc: call timed out after 20ms"}`))
+		require.True(t, time.Since(start) < 500*time.Millisecond)
+		require.Equal(t, context.DeadlineExceeded, <-cancelled)
+	}
+
+	// Timeouts requested by the client, up to the maximum.
+	for _, test := range []struct {
+		max    time.Duration
+		header string
+	}{
+		{0, "20ms"},
+		{20 * time.Millisecond, "1h"},
+	} {
+		server, err := rpcserver.NewServer(nil)
+		require.NoError(t, err)
+		server.RegisterCodec(jsonrpc2.NewCodec(), "application/json")
+		wait(server)
+		server.SetMaxTimeout(test.max)
+
+		start := time.Now()
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/jsonrpc/v1/Wait", strings.NewReader(request))
+		req.Header.Set(rpcserver.TimeoutHeader, test.header)
+		server.ServeHTTP(w, req)
+		body := ShowResponse(t, w)
+
+		require.True(t, strings.Contains(body, `"error":{"code":-32001,"message":"rpc: call timed out after 20ms"}`))
+		require.True(t, time.Since(start) < 500*time.Millisecond)
+		require.Equal(t, context.DeadlineExceeded, <-cancelled)
+	}
+}
+
+func Test_23_CancelRequest(t *testing.T) {
+	started := make(chan struct{})
+	server, err := rpcserver.NewServer(nil)
+	require.NoError(t, err)
+	codec := jsonrpc2.NewCodec()
+	codec.RespectNotifyMessages = true
+	server.RegisterCodec(codec, "application/json")
+	err = rpcserver.Handle(server, "Wait", func(ctx context.Context, args *MockArgs) (*MockReply, error) {
+		close(started)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Second):
+			return &MockReply{}, nil
+		}
+	})
+	require.NoError(t, err)
+
+	post := func(path, session, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", path, strings.NewReader(body))
+		req.Header.Set(rpcserver.SessionHeader, session)
+		server.ServeHTTP(w, req)
+		return w
+	}
+	done := make(chan string)
+	go func() {
+		w := post("/jsonrpc/v1/Wait", "s1", `{"jsonrpc": "2.0", "method": "Wait", "id":5}`)
+		done <- w.Body.String()
+	}()
+	<-started
+
+	// Another session can't cancel the call.
+	w := post("/jsonrpc/v1/$/cancelRequest", "s2", `{"jsonrpc": "2.0", "method": "$/cancelRequest", "params": {"id": 5}}`)
+	require.Equal(t, 204, w.Code)
+	select {
+	case <-done:
+		t.Fatal("cancelled by another session")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// Nor a client without a session.
+	w = post("/jsonrpc/v1/$/cancelRequest", "", `{"jsonrpc": "2.0", "method": "$/cancelRequest", "params": {"id": 5}}`)
+	require.Equal(t, 204, w.Code)
+	select {
+	case <-done:
+		t.Fatal("cancelled without a session")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	w = post("/jsonrpc/v1/$/cancelRequest", "s1", `{"jsonrpc": "2.0", "method": "$/cancelRequest", "params": {"id": 5}}`)
+	require.Equal(t, 204, w.Code)
+	select {
+	case body := <-done:
+		require.Equal(t, `{"jsonrpc":"2.0","error":{"code":-32800,"message":"rpc: request cancelled"},"id":5}`+"\n", body)
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("call was not cancelled")
+	}
+
+	// A cancellation with an id is answered.
+	w = post("/jsonrpc/v1/$/cancelRequest", "s1", `{"jsonrpc": "2.0", "method": "$/cancelRequest", "id":6, "params": {"id": 5}}`)
+	require.Equal(t, `{"jsonrpc":"2.0","result":null,"id":6}`+"\n", w.Body.String())
+}
+
+type MockDoc struct {
+	Name    string         `json:"name"`
+	Nick    *string        `json:"nick"`
+	Tags    []string       `json:"tags,omitempty"`
+	Attrs   map[string]int `json:"attrs"`
+	Created time.Time      `json:"created"`
+	Skipped int            `json:"-"`
+	hidden  int
+}
+
+func Test_24_Discover(t *testing.T) {
+	setup := func(server *rpcserver.Server) {
+		err := rpcserver.Handle(server, "Docs.Get", func(ctx context.Context, args *MockDoc) (*MockDoc, error) {
+			return args, nil
+		})
+		require.NoError(t, err)
+		require.NoError(t, server.SetParamNames("ActionParams", "name", "count", "flag"))
+		err = server.Describe("Docs.Get", &rpcserver.MethodDoc{
+			Summary: "Returns the doc",
+			Errors:  []*rpcserver.MethodError{{Code: -32004, Message: "not found"}},
+		})
+		require.NoError(t, err)
+		require.Error(t, server.Describe("Docs.Wrong", &rpcserver.MethodDoc{}))
+	}
+	_, w := performRequestWith(t, setup, "POST", "/jsonrpc/v1/rpc.discover", `{"jsonrpc": "2.0", "method": "rpc.discover", "id":1}`)
+	body := ShowResponse(t, w)
+
+	res := struct {
+		Result struct {
+			OpenRPC string
+			Methods []json.RawMessage
+		}
+	}{}
+	require.NoError(t, json.Unmarshal([]byte(body), &res))
+	require.Equal(t, "1.2.6", res.Result.OpenRPC)
+	methods := make(map[string]string)
+	for _, method := range res.Result.Methods {
+		name := struct{ Name string }{}
+		require.NoError(t, json.Unmarshal(method, &name))
+		methods[name.Name] = string(method)
+	}
+	require.JSONEq(t, `{
+		"name": "Docs.Get",
+		"summary": "Returns the doc",
+		"paramStructure": "by-name",
+		"params": [
+			{"name": "attrs", "required": true, "schema": {"type": "object", "additionalProperties": {"type": "integer", "format": "int64"}}},
+			{"name": "created", "required": true, "schema": {"type": "string", "format": "date-time"}},
+			{"name": "name", "required": true, "schema": {"type": "string"}},
+			{"name": "nick", "schema": {"type": "string"}},
+			{"name": "tags", "schema": {"type": "array", "items": {"type": "string"}}}
+		],
+		"result": {"name": "result", "schema": {
+			"type": "object",
+			"properties": {
+				"attrs": {"type": "object", "additionalProperties": {"type": "integer", "format": "int64"}},
+				"created": {"type": "string", "format": "date-time"},
+				"name": {"type": "string"},
+				"nick": {"type": "string"},
+				"tags": {"type": "array", "items": {"type": "string"}}
+			},
+			"required": ["name", "attrs", "created"]
+		}},
+		"errors": [{"code": -32004, "message": "not found"}]
+	}`, methods["Docs.Get"])
+	require.JSONEq(t, `{
+		"name": "ActionParams",
+		"paramStructure": "either",
+		"params": [
+			{"name": "name", "schema": {"type": "string"}},
+			{"name": "count", "schema": {"type": "integer", "format": "int64"}},
+			{"name": "flag", "schema": {"type": "boolean"}}
+		],
+		"result": {"name": "result", "schema": {"type": "string"}}
+	}`, methods["ActionParams"])
+	require.Contains(t, methods, "Action")
+	require.NotContains(t, methods, "rpc.discover")
+}
+
+type MockUser struct {
+	Name  string            `json:"name" validate:"required,max=8,pattern=^[a-z]{2,}$"`
+	Age   int               `json:"age" validate:"min=18,max=150"`
+	Role  string            `json:"role,omitempty" validate:"omitempty,enum=admin|user"`
+	Pets  []*MockUser       `json:"pets,omitempty" validate:"max=2"`
+	Email *string           `json:"email,omitempty"`
+	Tags  map[string]string `json:"tags,omitempty" validate:"max=2"`
+}
+
+func Test_25_Validation(t *testing.T) {
+	users := func(server *rpcserver.Server) {
+		err := rpcserver.Handle(server, "Users.Create", func(ctx context.Context, args *MockUser) (*MockUser, error) {
+			return args, nil
+		})
+		require.NoError(t, err)
+		schema := &rpcserver.Schema{Type: "object", Required: []string{"email"}}
+		require.NoError(t, server.SetParamsSchema("Users.Create", schema))
+	}
+	_, w := performRequestWith(t, users, "POST", "/jsonrpc/v1/Users.Create", `{"jsonrpc": "2.0", "method": "Users.Create", "id":1, "params": {"name": "bob", "age": 30, "role": "admin", "email": "bob@example.com"}}`)
+	body := ShowResponse(t, w)
+	require.True(t, strings.Contains(body, `"result":{"name":"bob"`))
+
+	_, w = performRequestWith(t, users, "POST", "/jsonrpc/v1/Users.Create", `{"jsonrpc": "2.0", "method": "Users.Create", "id":1, "params": {"name": "Bob", "age": 10, "role": "root", "pets": [{"age": 20}]}}`)
+	body = ShowResponse(t, w)
+	res := struct {
+		Error struct {
+			Code int
+			Data []*rpcserver.Violation
+		}
+	}{}
+	require.NoError(t, json.Unmarshal([]byte(body), &res))
+	require.Equal(t, -32602, res.Error.Code)
+	require.Equal(t, []*rpcserver.Violation{
+		{Field: "name", Message: "must match ^[a-z]{2,}$"},
+		{Field: "age", Message: "must be at least 18"},
+		{Field: "role", Message: "must be one of admin, user"},
+		{Field: "pets[0].name", Message: "required"},
+		{Field: "email", Message: "required"}, // from the schema
+	}, res.Error.Data)
+
+	// Rules apply to zero values, unless they are omitempty.
+	_, w = performRequestWith(t, users, "POST", "/jsonrpc/v1/Users.Create", `{"jsonrpc": "2.0", "method": "Users.Create", "id":1, "params": {"name": "bob", "age": 0, "email": "bob@example.com"}}`)
+	body = ShowResponse(t, w)
+	require.NoError(t, json.Unmarshal([]byte(body), &res))
+	require.Equal(t, []*rpcserver.Violation{
+		{Field: "age", Message: "must be at least 18"},
+	}, res.Error.Data)
+
+	schema := rpcserver.SchemaOf(reflect.TypeOf(MockUser{}))
+	data, err := json.Marshal(schema.Properties["name"])
+	require.NoError(t, err)
+	require.JSONEq(t, `{"type": "string", "maxLength": 8, "pattern": "^[a-z]{2,}$"}`, string(data))
+	data, err = json.Marshal(schema.Properties["age"])
+	require.NoError(t, err)
+	require.JSONEq(t, `{"type": "integer", "format": "int64", "minimum": 18, "maximum": 150}`, string(data))
+	data, err = json.Marshal(schema.Properties["tags"])
+	require.NoError(t, err)
+	require.JSONEq(t, `{"type": "object", "additionalProperties": {"type": "string"}, "maxProperties": 2}`, string(data))
+
+	// Several parameters are validated as sent.
+	one := 1.0
+	params := func(server *rpcserver.Server) {
+		require.NoError(t, server.SetParamNames("ActionParams", "name", "count", "flag"))
+		require.NoError(t, server.SetParamsSchema("ActionParams", &rpcserver.Schema{
+			Type:       "object",
+			Required:   []string{"name"},
+			Properties: map[string]*rpcserver.Schema{"count": {Minimum: &one}},
+		}))
+	}
+	_, w = performRequestWith(t, params, "POST", "/jsonrpc/v1/ActionParams", `{"jsonrpc": "2.0", "method": "ActionParams", "id":1, "params": {"name": "x", "count": 2}}`)
+	body = ShowResponse(t, w)
+	require.True(t, strings.Contains(body, `"result":"x 2 false"`))
+	_, w = performRequestWith(t, params, "POST", "/jsonrpc/v1/ActionParams", `{"jsonrpc": "2.0", "method": "ActionParams", "id":1, "params": ["x", 0]}`)
+	body = ShowResponse(t, w)
+	require.True(t, strings.Contains(body, `"data":[{"field":"count","message":"must be at least 1"}]`))
+
+	// Malformed rules are reported at registration.
+	server, err := rpcserver.NewServer(nil)
+	require.NoError(t, err)
+	err = rpcserver.Handle(server, "Bad", func(ctx context.Context, args *MockBadRules) (*MockReply, error) {
+		return &MockReply{}, nil
+	})
+	require.Error(t, err)
+	require.False(t, server.HasMethod("Bad"))
+	err = rpcserver.Handle(server, "Good", func(ctx context.Context, args *MockUser) (*MockReply, error) {
+		return &MockReply{}, nil
+	})
+	require.NoError(t, err)
+	require.Error(t, server.SetParamsSchema("Good", &rpcserver.Schema{Pattern: "("}))
+	require.Error(t, server.SetParamsSchema("Wrong", &rpcserver.Schema{}))
+}
+
+type MockBadRules struct {
+	Age int `validate:"min=eighteen"`
+}
+
+func Test_26_Strict(t *testing.T) {
+	strict := func(server *rpcserver.Server) {
+		server.RegisterCodec(&jsonrpc2.Codec{Strict: true}, "application/json")
+	}
+	_, w := performRequestWith(t, strict, "POST", "/jsonrpc/v1/Action", `{"jsonrpc": "2.0", "method": "Action", "id":1, "params": {"a": 5, "B": 2}}`)
+	body := ShowResponse(t, w)
+	require.Equal(t, `{"jsonrpc":"2.0","result":{"Value":3},"id":1}`+"\n", body)
+
+	_, w = performRequestWith(t, strict, "POST", "/jsonrpc/v1/Action", `{"jsonrpc": "2.0", "method": "Action", "id":1, "params": {"A": 5, "C": 2}}`)
+	body = ShowResponse(t, w)
+	require.Equal(t, `{"jsonrpc":"2.0","error":{"code":-32602,"message":"unknown field \"C\"","data":[{"field":"C","message":"unknown field"}]},"id":1}`+"\n", body)
+
+	_, w = performRequestWith(t, strict, "POST", "/jsonrpc/v1/Action", `{"jsonrpc": "2.0", "method": "Action", "id":1, "params": [{"A": 5, "A": 2}]}`)
+	body = ShowResponse(t, w)
+	require.True(t, strings.Contains(body, `"code":-32602,"message":"duplicate key \"[0].A\""`))
+
+	_, w = performRequestWith(t, strict, "POST", "/jsonrpc/v1/Action", `{"jsonrpc": "2.0", "method": "Action", "id":1, "parms": {"A": 5, "B": 2}}`)
+	body = ShowResponse(t, w)
+	require.True(t, strings.Contains(body, `"code":-32600,"message":"unknown field \"parms\""`))
+
+	_, w = performRequestWith(t, strict, "POST", "/jsonrpc/v1/Action", `{"jsonrpc": "2.0", "method": "Action", "id":1, "params": {"A": 5, "B": 2}} {}`)
+	body = ShowResponse(t, w)
+	require.True(t, strings.Contains(body, `"code":-32600,"message":"trailing data after request"`))
+
+	_, w = performRequestWith(t, strict, "POST", "/jsonrpc/v1/Action", `[{"jsonrpc": "2.0", "method": "Action", "id":1, "id":2}]`)
+	body = ShowResponse(t, w)
+	require.True(t, strings.Contains(body, `"code":-32600,"message":"duplicate key \"id\""`))
+
+	// Not checked by default.
+	_, w = performRequest(t, "POST", "/jsonrpc/v1/Action", `{"jsonrpc": "2.0", "method": "Action", "id":1, "params": {"A": 5, "C": 2}} {}`)
+	body = ShowResponse(t, w)
+	require.Equal(t, `{"jsonrpc":"2.0","result":{"Value":5},"id":1}`+"\n", body)
+}
+
+type MockIds struct {
+	Id    int64
+	Ids   []uint64    `json:"ids,omitempty"`
+	Any   interface{} `json:"any,omitempty"`
+	Float float64     `json:"float,omitempty"`
+	Small int32       `json:"small,string,omitempty"`
+	Big   int64       `json:"big,string,omitempty"`
+}
+
+func Test_27_Numbers(t *testing.T) {
+	echo := func(codec *jsonrpc2.Codec) func(*rpcserver.Server) {
+		return func(server *rpcserver.Server) {
+			server.RegisterCodec(codec, "application/json")
+			err := rpcserver.Handle(server, "Ids.Echo", func(ctx context.Context, args *MockIds) (*MockIds, error) {
+				if args.Any != nil {
+					args.Any = fmt.Sprintf("%T %v", args.Any, args.Any)
+				}
+				return args, nil
+			})
+			require.NoError(t, err)
+		}
+	}
+	_, w := performRequestWith(t, echo(jsonrpc2.NewCodec()), "POST", "/jsonrpc/v1/Ids.Echo", `{"jsonrpc": "2.0", "method": "Ids.Echo", "id":1, "params": {"Id": 9007199254740993, "any": 9007199254740993}}`)
+	body := ShowResponse(t, w)
+	require.True(t, strings.Contains(body, `"result":{"Id":9007199254740993,"any":"float64 9.007199254740992e+15"}`))
+
+	_, w = performRequestWith(t, echo(&jsonrpc2.Codec{UseNumber: true}), "POST", "/jsonrpc/v1/Ids.Echo", `{"jsonrpc": "2.0", "method": "Ids.Echo", "id":1, "params": {"Id": 1, "any": 9007199254740993}}`)
+	body = ShowResponse(t, w)
+	require.True(t, strings.Contains(body, `"result":{"Id":1,"any":"json.Number 9007199254740993"}`))
+
+	codec := &jsonrpc2.Codec{IntsAsStrings: true}
+	_, w = performRequestWith(t, echo(codec), "POST", "/jsonrpc/v1/Ids.Echo", `{"jsonrpc": "2.0", "method": "Ids.Echo", "id":1, "params": {"Id": "9007199254740993", "ids": [1, "18446744073709551615"], "float": 0.5}}`)
+	body = ShowResponse(t, w)
+	require.True(t, strings.Contains(body, `"result":{"Id":"9007199254740993","ids":["1","18446744073709551615"],"float":0.5}`))
+
+	_, w = performRequestWith(t, echo(codec), "POST", "/jsonrpc/v1/Ids.Echo", `{"jsonrpc": "2.0", "method": "Ids.Echo", "id":1, "params": [{"Id": "-5"}]}`)
+	body = ShowResponse(t, w)
+	require.True(t, strings.Contains(body, `"result":{"Id":"-5"}`))
+
+	_, w = performRequestWith(t, echo(codec), "POST", "/jsonrpc/v1/Ids.Echo", `{"jsonrpc": "2.0", "method": "Ids.Echo", "id":1, "params": {"Id": 1, "small": "7", "big": "9007199254740993"}}`)
+	body = ShowResponse(t, w)
+	require.True(t, strings.Contains(body, `"result":{"Id":"1","small":"7","big":"9007199254740993"}`))
+
+	_, w = performRequestWith(t, echo(jsonrpc2.NewCodec()), "POST", "/jsonrpc/v1/Ids.Echo", `{"jsonrpc": "2.0", "method": "Ids.Echo", "id":1, "params": {"Id": 1.5}}`)
+	body = ShowResponse(t, w)
+	require.True(t, strings.Contains(body, `"code":-32602,"message":"Id: 1.5 is not an integer"`))
+
+	_, w = performRequestWith(t, echo(codec), "POST", "/jsonrpc/v1/Ids.Echo", `{"jsonrpc": "2.0", "method": "Ids.Echo", "id":1, "params": [{"Id": "2.5"}]}`)
+	body = ShowResponse(t, w)
+	require.True(t, strings.Contains(body, `"code":-32602,"message":"Id: 2.5 is not an integer"`))
+
+	_, w = performRequestWith(t, echo(jsonrpc2.NewCodec()), "POST", "/jsonrpc/v1/Ids.Echo", `{"jsonrpc": "2.0", "method": "Ids.Echo", "id":1, "params": {"Id": 9223372036854775808}}`)
+	body = ShowResponse(t, w)
+	require.True(t, strings.Contains(body, `"code":-32602,"message":"Id: 9223372036854775808 is out of range for int64"`))
+
+	_, w = performRequestWith(t, echo(jsonrpc2.NewCodec()), "POST", "/jsonrpc/v1/Ids.Echo", `{"jsonrpc": "2.0", "method": "Ids.Echo", "id":1, "params": {"Id": 1e3, "ids": [2.0], "float": 1e3}}`)
+	body = ShowResponse(t, w)
+	require.True(t, strings.Contains(body, `"result":{"Id":1000,"ids":[2],"float":1000}`))
+
+	_, w = performRequestWith(t, echo(codec), "POST", "/jsonrpc/v1/Ids.Echo", `{"jsonrpc": "2.0", "method": "Ids.Echo", "id":1, "params": {"Id": "1e3"}}`)
+	body = ShowResponse(t, w)
+	require.True(t, strings.Contains(body, `"result":{"Id":"1000"}`))
+
+	_, w = performRequestWith(t, echo(jsonrpc2.NewCodec()), "POST", "/jsonrpc/v1/Ids.Echo", `{"jsonrpc": "2.0", "method": "Ids.Echo", "id":1, "params": {"Id": 1e30}}`)
+	body = ShowResponse(t, w)
+	require.True(t, strings.Contains(body, `"code":-32602,"message":"Id: 1e30 is out of range for int64"`))
+
+	_, w = performRequestWith(t, echo(jsonrpc2.NewCodec()), "POST", "/jsonrpc/v1/Ids.Echo", `{"jsonrpc": "2.0", "method": "Ids.Echo", "id":1, "params": {"Id": 1.00000000000000000001}}`)
+	body = ShowResponse(t, w)
+	require.True(t, strings.Contains(body, `"code":-32602,"message":"Id: 1.00000000000000000001 is not an integer"`))
+
+	// The OpenRPC document keeps its numbers and describes the integers sent
+	// as strings as strings.
+	setup := func(server *rpcserver.Server) {
+		server.RegisterCodec(codec, "application/json")
+		err := server.Describe("Action", &rpcserver.MethodDoc{
+			Errors: []*rpcserver.MethodError{{Code: -32010, Message: "too big"}},
+		})
+		require.NoError(t, err)
+	}
+	_, w = performRequestWith(t, setup, "POST", "/jsonrpc/v1/rpc.discover", `{"jsonrpc": "2.0", "method": "rpc.discover", "id":1}`)
+	body = ShowResponse(t, w)
+	require.True(t, strings.Contains(body, `"errors":[{"code":-32010,"message":"too big"}]`))
+	require.True(t, strings.Contains(body, `{"name":"A","required":true,"schema":{"type":"string","format":"int64"}}`))
+
+	schema, err := json.Marshal(rpcserver.SchemaOf(reflect.TypeOf(MockIds{})).Properties)
+	require.NoError(t, err)
+	require.JSONEq(t, `{
+		"Id": {"type": "integer", "format": "int64"},
+		"ids": {"type": "array", "items": {"type": "integer", "format": "uint64"}},
+		"any": {},
+		"float": {"type": "number"},
+		"small": {"type": "string", "format": "int32"},
+		"big": {"type": "string", "format": "int64"}
+	}`, string(schema))
+}
+
+// endlessReader reads the byte forever, counting the bytes read.
+type endlessReader struct {
+	b    byte
+	read int
+}
+
+func (e *endlessReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = e.b
+	}
+	e.read += len(p)
+	return len(p), nil
+}
+
+func Test_28_Limits(t *testing.T) {
+	limits := jsonrpc2.Limits{
+		MaxBodyBytes:    200,
+		MaxDepth:        3,
+		MaxArrayLength:  2,
+		MaxStringLength: 10,
+		MaxBatchSize:    2,
+	}
+	request := `{"jsonrpc": "2.0", "method": "Action", "id":1, "params": %s}`
+	tests := []struct {
+		body   string
+		status int
+		expect string
+	}{
+		{fmt.Sprintf(request, `[{"A": 5, "B": 2}]`), 200, `"result":{"Value":3}`},
+		{fmt.Sprintf(request, `[{"A": 5, "B": 2}, {}, {}]`), 413, `"message":"array exceeds 2 elements"`},
+		{fmt.Sprintf(request, `[{"A": [[1]]}]`), 413, `"message":"nesting exceeds depth 3"`},
+		{fmt.Sprintf(request, `{"A": "12345678901"}`), 413, `"message":"string exceeds 10 bytes"`},
+		{fmt.Sprintf(request, `{"A": 5, "B": 2, "C": "`+strings.Repeat(`\"`, 5)+`"}`), 200, `"result":{"Value":3}`},
+		{fmt.Sprintf(request, `{"A": 5, "B": 2, "C": "`+strings.Repeat(`\"`, 6)+`"}`), 413, `"message":"string exceeds 10 bytes"`},
+		{fmt.Sprintf(request, `{"A": 5, "B": 2}`+strings.Repeat(" ", 200)), 413, `"message":"body exceeds 200 bytes"`},
+		{"[" + strings.Repeat(fmt.Sprintf(request, `{}`)+",", 2) + "{}]", 413, `"message":"batch exceeds 2 requests"`},
+	}
+	for _, test := range tests {
+		setup := func(server *rpcserver.Server) {
+			server.RegisterCodec(&jsonrpc2.Codec{Limits: limits}, "application/json")
+			server.SetStatusPolicy(rpcserver.StatusREST)
+		}
+		_, w := performRequestWith(t, setup, "POST", "/jsonrpc/v1/Action", test.body)
+		body := ShowResponse(t, w)
+		require.Equal(t, test.status, w.Code, test.body)
+		require.True(t, strings.Contains(body, test.expect), test.body)
+		if test.status == 413 {
+			require.True(t, strings.Contains(body, `"code":-32002`))
+		}
+	}
+
+	// The body is not read to the end.
+	server, err := rpcserver.NewServer(NewMockRpcObject(t))
+	require.NoError(t, err)
+	server.RegisterCodec(&jsonrpc2.Codec{Limits: jsonrpc2.Limits{MaxDepth: 100}}, "application/json")
+	endless := &endlessReader{b: '['}
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/jsonrpc/v1/Action", endless)
+	server.ServeHTTP(w, req)
+	body := ShowResponse(t, w)
+	require.Equal(t, 200, w.Code) // default status policy
+	require.True(t, strings.Contains(body, `"message":"nesting exceeds depth 100"`))
+	require.True(t, endless.read < 1<<20)
+}
+
+func Test_29_Routing(t *testing.T) {
+	routing := func(mode rpcserver.Routing) func(*rpcserver.Server) {
+		return func(server *rpcserver.Server) {
+			server.SetRouting(mode)
+		}
+	}
+	mock, w := performRequestWith(t, routing(rpcserver.RoutePathSuffix), "POST", "/jsonrpc/v1/Action", `{"jsonrpc": "2.0", "method": "ActionReturn", "id":1, "params": {"A": 5, "B": 2}}`)
+	body := ShowResponse(t, w)
+	require.Equal(t, 0, mock.Called)
+	require.True(t, strings.Contains(body, `"code":-32601`))
+
+	mock, w = performRequestWith(t, routing(rpcserver.RouteSingleEndpoint), "POST", "/jsonrpc/v1/rpc", `{"jsonrpc": "2.0", "method": "ActionReturn", "id":1, "params": {"A": 5, "B": 2}}`)
+	body = ShowResponse(t, w)
+	require.Equal(t, 1, mock.Called)
+	require.True(t, strings.Contains(body, `"result":{"Value":3}`))
+
+	mock, w = performRequestWith(t, routing(rpcserver.RouteSingleEndpoint), "POST", "/jsonrpc/v1/rpc", `{"jsonrpc": "2.0", "method": "Wrong", "id":1, "params": {"A": 5, "B": 2}}`)
+	body = ShowResponse(t, w)
+	require.Equal(t, 0, mock.Called)
+	require.True(t, strings.Contains(body, `"code":-32601`))
+
+	_, w = performRequestWith(t, routing(rpcserver.RouteSingleEndpoint), "POST", "/jsonrpc/v1/rpc", `{"jsonrpc": "2.0", "method": "rpc.discover", "id":1, "params": {"A": 5, "B": 2}}`)
+	body = ShowResponse(t, w)
+	require.True(t, strings.Contains(body, `"openrpc":"1.2.6"`))
+
+	namespace := func(server *rpcserver.Server) {
+		server.SetRouting(rpcserver.RoutePrefixNamespace)
+		require.NoError(t, server.RegisterService(NewMockRpcObject(t), "Mock"))
+	}
+	_, w = performRequestWith(t, namespace, "POST", "/jsonrpc/v1/Mock", `{"jsonrpc": "2.0", "method": "ActionParams", "id":1, "params": ["a", 1]}`)
+	body = ShowResponse(t, w)
+	require.True(t, strings.Contains(body, `"result":"a 1 false"`))
+
+	_, w = performRequestWith(t, namespace, "POST", "/jsonrpc/v1/Mock", `{"jsonrpc": "2.0", "method": "rpc.discover", "id":1}`)
+	body = ShowResponse(t, w)
+	require.True(t, strings.Contains(body, `"openrpc":"1.2.6"`))
+
+	_, w = performRequestWith(t, namespace, "POST", "/jsonrpc/v1/Wrong", `{"jsonrpc": "2.0", "method": "ActionParams", "id":1, "params": ["a", 1]}`)
+	require.Equal(t, 404, w.Code)
+}
+
+func Test_30_NameMapper(t *testing.T) {
+	setup := func(server *rpcserver.Server) {
+		require.NoError(t, server.RegisterService(NewMockRpcObject(t), "HTTPMock"))
+		require.NoError(t, server.SetNameMapper(rpcserver.LowerCamel(rpcserver.DottedNames)))
+		require.True(t, server.HasMethod("httpMock.actionParams"))
+		require.True(t, server.HasMethod("actionParams"))
+		require.False(t, server.HasMethod("HTTPMock.ActionParams"))
+
+		require.NoError(t, server.SetNameMapper(rpcserver.SnakeCase(rpcserver.UnderscoreNames)))
+		require.True(t, server.HasMethod("http_mock_action_params"))
+		require.False(t, server.HasMethod("httpMock.actionParams"))
+
+		require.NoError(t, server.SetAliases("http_mock_action_params", "params"))
+		require.True(t, server.HasMethod("params"))
+		require.Error(t, server.SetAliases("action", "action_params")) // used by another method
+		require.True(t, server.HasMethod("action"))
+		require.NoError(t, server.SetMethodTimeout("params", time.Second)) // by the alias
+
+		require.Error(t, server.SetNameMapper(nil))
+		require.True(t, server.HasMethod("http_mock_action_params"))
+	}
+	_, w := performRequestWith(t, setup, "POST", "/jsonrpc/v1/http_mock_action_params", `{"jsonrpc": "2.0", "method": "http_mock_action_params", "id":1, "params": ["a", 1]}`)
+	body := ShowResponse(t, w)
+	require.True(t, strings.Contains(body, `"result":"a 1 false"`))
+
+	_, w = performRequestWith(t, setup, "POST", "/jsonrpc/v1/params", `{"jsonrpc": "2.0", "method": "params", "id":1, "params": ["b", 2]}`)
+	body = ShowResponse(t, w)
+	require.True(t, strings.Contains(body, `"result":"b 2 false"`))
+
+	_, w = performRequestWith(t, setup, "POST", "/jsonrpc/v1/rpc.discover", `{"jsonrpc": "2.0", "method": "rpc.discover", "id":1}`)
+	body = ShowResponse(t, w)
+	require.True(t, strings.Contains(body, `"name":"http_mock_action_params"`))
+	require.True(t, strings.Contains(body, `"name":"action_context"`))
+	require.False(t, strings.Contains(body, `"name":"params"`))
+	require.False(t, strings.Contains(body, `"name":"ActionContext"`))
+
+	namespace := func(server *rpcserver.Server) {
+		setup(server)
+		server.SetRouting(rpcserver.RoutePrefixNamespace)
+	}
+	_, w = performRequestWith(t, namespace, "POST", "/jsonrpc/v1/HTTPMock", `{"jsonrpc": "2.0", "method": "ActionParams", "id":1, "params": ["c", 3]}`)
+	body = ShowResponse(t, w)
+	require.True(t, strings.Contains(body, `"result":"c 3 false"`))
+}
+
+type MockOptionsObject struct{}
+
+func (m *MockOptionsObject) Get(ctx context.Context, args *MockArgs) (*MockReply, error) {
+	return &MockReply{Value: args.A}, nil
+}
+
+func (m *MockOptionsObject) Delete(ctx context.Context, args *MockArgs) (*MockReply, error) {
+	return &MockReply{}, nil
+}
+
+func (m *MockOptionsObject) Secret(ctx context.Context, args *MockArgs) (*MockReply, error) {
+	return &MockReply{}, nil
+}
+
+func (m *MockOptionsObject) Put(ctx context.Context, args *MockArgs) (*MockReply, error) {
+	return &MockReply{Value: args.A}, nil
+}
+
+func (m *MockOptionsObject) Count(ctx context.Context, names ...string) (int, error) {
+	return len(names), nil
+}
+
+func (m *MockOptionsObject) Helper() string {
+	return "not a method"
+}
+
+func (m *MockOptionsObject) Reset(args *MockArgs) error {
+	return nil
+}
+
+func (m *MockOptionsObject) DescribeMethods() map[string]*rpcserver.MethodOptions {
+	return map[string]*rpcserver.MethodOptions{
+		"Get":    {Description: "Gets the value", Idempotent: true, RateLimit: 1},
+		"Delete": {Deprecated: true, Permissions: []string{"admin"}},
+		"Secret": {Hidden: true},
+		"Put":    nil,
+	}
+}
+
+func Test_31_MethodOptions(t *testing.T) {
+	var checked []string
+	setup := func(server *rpcserver.Server) {
+		require.NoError(t, server.RegisterService(&MockOptionsObject{}, "Opts"))
+		require.Equal(t, []*rpcserver.SkippedMethod{
+			{Service: "Opts", Method: "Count", Reason: "variadic"},
+			{Service: "Opts", Method: "Helper", Reason: "no arguments"},
+			{Service: "Opts", Method: "Reset", Reason: "first argument is not *http.Request or context.Context"},
+		}, server.SkippedMethods())
+		server.SetStatusPolicy(rpcserver.StatusREST)
+	}
+	_, w := performRequestWith(t, setup, "POST", "/jsonrpc/v1/Opts.Get", `[
+		{"jsonrpc": "2.0", "method": "Opts.Get", "id":1, "params": {"A": 5}},
+		{"jsonrpc": "2.0", "method": "Opts.Get", "id":2, "params": {"A": 5}}
+	]`)
+	body := ShowResponse(t, w)
+	require.True(t, strings.Contains(body, `{"jsonrpc":"2.0","result":{"Value":5},"id":1}`))
+	require.True(t, strings.Contains(body, `{"jsonrpc":"2.0","error":{"code":-32004,"message":"rate limit exceeded"},"id":2}`))
+
+	_, w = performRequestWith(t, setup, "POST", "/jsonrpc/v1/Opts.Delete", `{"jsonrpc": "2.0", "method": "Opts.Delete", "id":1, "params": {}}`)
+	body = ShowResponse(t, w)
+	require.Equal(t, 403, w.Code)
+	require.True(t, strings.Contains(body, `"code":-32003`))
+
+	checker := func(server *rpcserver.Server) {
+		setup(server)
+		server.SetPermissionChecker(func(ctx context.Context, permissions []string) error {
+			checked = append(checked, rpcserver.MethodFromContext(ctx))
+			checked = append(checked, permissions...)
+			return nil
+		})
+	}
+	_, w = performRequestWith(t, checker, "POST", "/jsonrpc/v1/Opts.Delete", `{"jsonrpc": "2.0", "method": "Opts.Delete", "id":1, "params": {}}`)
+	body = ShowResponse(t, w)
+	require.Equal(t, 200, w.Code)
+	require.True(t, strings.Contains(body, `"result":{"Value":0}`))
+	require.Equal(t, []string{"Opts.Delete", "admin"}, checked)
+
+	// Errors without a code deny the call, their message is hidden in
+	// production.
+	denier := func(mode rpcserver.ErrorMode, err error) func(server *rpcserver.Server) {
+		return func(server *rpcserver.Server) {
+			setup(server)
+			server.SetErrorMode(mode)
+			server.SetPermissionChecker(func(ctx context.Context, permissions []string) error {
+				return err
+			})
+		}
+	}
+	_, w = performRequestWith(t, denier(rpcserver.ErrorsAsIs, errors.New("token expired")), "POST", "/jsonrpc/v1/Opts.Delete", `{"jsonrpc": "2.0", "method": "Opts.Delete", "id":1, "params": {}}`)
+	body = ShowResponse(t, w)
+	require.Equal(t, 403, w.Code)
+	require.True(t, strings.Contains(body, `"code":-32003,"message":"token expired"`))
+
+	_, w = performRequestWith(t, denier(rpcserver.ErrorsProduction, errors.New("token expired")), "POST", "/jsonrpc/v1/Opts.Delete", `{"jsonrpc": "2.0", "method": "Opts.Delete", "id":1, "params": {}}`)
+	body = ShowResponse(t, w)
+	require.Equal(t, 403, w.Code)
+	require.True(t, strings.Contains(body, `"code":-32003,"message":"permission denied"`))
+
+	_, w = performRequestWith(t, denier(rpcserver.ErrorsProduction, &rpcserver.Error{Code: -32010, Message: "too many sessions"}), "POST", "/jsonrpc/v1/Opts.Delete", `{"jsonrpc": "2.0", "method": "Opts.Delete", "id":1, "params": {}}`)
+	body = ShowResponse(t, w)
+	require.True(t, strings.Contains(body, `"code":-32010,"message":"too many sessions"`))
+
+	_, w = performRequestWith(t, setup, "POST", "/jsonrpc/v1/rpc.discover", `{"jsonrpc": "2.0", "method": "rpc.discover", "id":1}`)
+	body = ShowResponse(t, w)
+	require.True(t, strings.Contains(body, `"name":"Opts.Get","description":"Gets the value"`))
+	require.True(t, strings.Contains(body, `"x-idempotent":true`))
+	require.True(t, strings.Contains(body, `"deprecated":true,"x-permissions":["admin"]`))
+	require.False(t, strings.Contains(body, `Opts.Secret`))
+
+	// Nil clears the options.
+	clear := func(server *rpcserver.Server) {
+		setup(server)
+		require.NoError(t, server.SetMethodOptions("Opts.Delete", nil))
+	}
+	_, w = performRequestWith(t, clear, "POST", "/jsonrpc/v1/Opts.Delete", `{"jsonrpc": "2.0", "method": "Opts.Delete", "id":1, "params": {}}`)
+	body = ShowResponse(t, w)
+	require.Equal(t, 200, w.Code)
+	require.True(t, strings.Contains(body, `"result":{"Value":0}`))
+}
+
+type MockLifecycleObject struct {
+	Inited  bool
+	Closed  bool
+	started chan struct{}
+	release chan struct{}
+	onInit  func(ctx context.Context) error
+}
+
+func (m *MockLifecycleObject) Init(ctx context.Context) error {
+	m.Inited = true
+	if m.onInit != nil {
+		return m.onInit(ctx)
+	}
+	return nil
+}
+
+func (m *MockLifecycleObject) Close() error {
+	m.Closed = true
+	return nil
+}
+
+func (m *MockLifecycleObject) Wait(ctx context.Context, args *MockArgs) (*MockReply, error) {
+	close(m.started)
+	<-m.release
+	return &MockReply{Value: args.A}, nil
+}
+
+func Test_32_Shutdown(t *testing.T) {
+	mock := &MockLifecycleObject{started: make(chan struct{}), release: make(chan struct{})}
+	server, err := rpcserver.NewServer(nil)
+	require.NoError(t, err)
+	require.NoError(t, server.RegisterService(mock, "Life"))
+	server.RegisterCodec(jsonrpc2.NewCodec(), "application/json")
+	require.True(t, mock.Inited)
+	require.True(t, server.HasMethod("Life.Wait"))
+	require.False(t, server.HasMethod("Life.Close"))
+	require.Empty(t, server.SkippedMethods())
+
+	serve := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/jsonrpc/v1/Life.Wait", strings.NewReader(body))
+		server.ServeHTTP(w, req)
+		return w
+	}
+	running := make(chan *httptest.ResponseRecorder)
+	go func() {
+		running <- serve(`{"jsonrpc": "2.0", "method": "Life.Wait", "id":1, "params": {"A": 5}}`)
+	}()
+	<-mock.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, server.Shutdown(ctx), context.DeadlineExceeded) // the call is running
+	require.False(t, mock.Closed)
+
+	body := ShowResponse(t, serve(`{"jsonrpc": "2.0", "method": "Life.Wait", "id":2, "params": {"A": 5}}`))
+	require.Equal(t, `{"jsonrpc":"2.0","error":{"code":-32005,"message":"server shutting down"},"id":2}`+"\n", body)
+
+	shutdown := make(chan error)
+	go func() {
+		shutdown <- server.Shutdown(context.Background())
+	}()
+	close(mock.release)
+	body = ShowResponse(t, <-running)
+	require.Equal(t, `{"jsonrpc":"2.0","result":{"Value":5},"id":1}`+"\n", body)
+	require.NoError(t, <-shutdown)
+	require.True(t, mock.Closed)
+}
+
+func Test_32_InitRegistersMethods(t *testing.T) {
+	server, err := rpcserver.NewServer(nil)
+	require.NoError(t, err)
+	mock := &MockLifecycleObject{onInit: func(ctx context.Context) error {
+		return rpcserver.Handle(server, "Life.Ping", func(ctx context.Context, args *MockArgs) (*MockReply, error) {
+			return &MockReply{}, nil
+		})
+	}}
+	require.NoError(t, server.RegisterService(mock, "Init"))
+	require.True(t, server.HasMethod("Life.Ping"))
+	require.True(t, server.HasMethod("Init.Wait"))
+
+	// A receiver which can't be registered is stopped.
+	duplicate := &MockLifecycleObject{}
+	require.Error(t, server.RegisterService(duplicate, "Init"))
+	require.True(t, duplicate.Inited)
+	require.True(t, duplicate.Closed)
+	require.False(t, mock.Closed)
+
+	// A registered receiver is neither initialized again nor stopped.
+	inits := 0
+	shared := &MockLifecycleObject{onInit: func(ctx context.Context) error {
+		inits++
+		return nil
+	}}
+	require.NoError(t, server.RegisterService(shared, "A"))
+	require.Error(t, server.RegisterService(shared, "A"))
+	require.NoError(t, server.RegisterService(shared, "B"))
+	require.Equal(t, 1, inits)
+	require.False(t, shared.Closed)
+	require.True(t, server.HasMethod("A.Wait"))
+
+	// Init gets the context of the registration.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cancelled := &MockLifecycleObject{onInit: func(ctx context.Context) error {
+		return ctx.Err()
+	}}
+	require.ErrorIs(t, server.RegisterServiceContext(ctx, cancelled, "Cancelled"), context.Canceled)
+	require.False(t, server.HasMethod("Cancelled.Wait"))
+	require.ErrorIs(t, server.ReplaceServiceContext(ctx, cancelled, "Init"), context.Canceled)
+	require.NoError(t, server.RegisterServiceContext(context.Background(), cancelled, "Cancelled"))
+}
+
+type MockValueObject struct {
+	Value int
+}
+
+func (m *MockValueObject) Wait(ctx context.Context, args *MockArgs) (*MockReply, error) {
+	return &MockReply{Value: m.Value}, nil
+}
+
+func (m *MockValueObject) Get(ctx context.Context, args *MockArgs) (*MockReply, error) {
+	return &MockReply{Value: m.Value}, nil
+}
+
+func Test_33_DynamicServices(t *testing.T) {
+	old := &MockLifecycleObject{started: make(chan struct{}), release: make(chan struct{})}
+	server, err := rpcserver.NewServer(nil)
+	require.NoError(t, err)
+	require.NoError(t, server.RegisterService(old, "Life"))
+	server.RegisterCodec(jsonrpc2.NewCodec(), "application/json")
+
+	serve := func(body string) string {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/jsonrpc/v1/Life.Wait", strings.NewReader(body))
+		server.ServeHTTP(w, req)
+		return ShowResponse(t, w)
+	}
+	running := make(chan string)
+	go func() {
+		running <- serve(`{"jsonrpc": "2.0", "method": "Life.Wait", "id":1, "params": {"A": 5}}`)
+	}()
+	<-old.started
+
+	require.NoError(t, server.SetAliases("Life.Wait", "wait"))
+	require.NoError(t, server.SetMethodTimeout("Life.Wait", time.Second))
+	err = rpcserver.Handle(server, "Life.Ping", func(ctx context.Context, args *MockArgs) (*MockReply, error) {
+		return &MockReply{}, nil
+	})
+	require.NoError(t, err)
+	require.NoError(t, server.ReplaceService(&MockValueObject{Value: 42}, "Life"))
+	require.Error(t, server.ReplaceService(&MockValueObject{}, "Wrong"))
+	body := serve(`{"jsonrpc": "2.0", "method": "Life.Wait", "id":2, "params": {"A": 5}}`)
+	require.Equal(t, `{"jsonrpc":"2.0","result":{"Value":42},"id":2}`+"\n", body)
+	require.True(t, server.HasMethod("wait")) // settings kept
+	require.True(t, server.HasMethod("Life.Ping"))
+	require.True(t, server.HasMethod("Life.Get"))
+
+	// The methods added with Handle can't be replaced by the receiver.
+	err = rpcserver.Handle(server, "Other.Get", func(ctx context.Context, args *MockArgs) (*MockReply, error) {
+		return &MockReply{}, nil
+	})
+	require.NoError(t, err)
+	require.Error(t, server.ReplaceService(&MockValueObject{}, "Other"))
+	require.NoError(t, server.UnregisterService("Other"))
+
+	close(old.release)
+	body = <-running
+	require.Equal(t, `{"jsonrpc":"2.0","result":{"Value":5},"id":1}`+"\n", body) // old implementation
+
+	require.NoError(t, server.UnregisterService("Life"))
+	require.Error(t, server.UnregisterService("Life"))
+	require.False(t, server.HasMethod("Life.Wait"))
+
+	// Discovery never sees a half registered service.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			if err := server.RegisterService(&MockValueObject{}, "Extra"); err != nil {
+				t.Error(err)
+				return
+			}
+			if err := server.UnregisterService("Extra"); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for finished := false; !finished; {
+		select {
+		case <-done:
+			finished = true
+		default:
+		}
+		methods := server.Discover().Methods
+		require.True(t, len(methods) == 0 || len(methods) == 2, "methods: %d", len(methods))
+	}
+}
+
+func Test_33_ConfigureWhileServing(t *testing.T) {
+	server, err := rpcserver.NewServer(&MockValueObject{Value: 7})
+	require.NoError(t, err)
+	server.RegisterCodec(jsonrpc2.NewCodec(), "application/json")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/jsonrpc/v1/Get", strings.NewReader(`{"jsonrpc": "2.0", "method": "Get", "id":1, "params": {"A": 1}}`))
+			server.ServeHTTP(w, req)
+			if !strings.Contains(w.Body.String(), `"result":{"Value":7}`) {
+				t.Error(w.Body.String())
+				return
+			}
+		}
+	}()
+	pass := func(ctx context.Context, call *rpcserver.Call, next rpcserver.Invoker) (interface{}, error) {
+		return next(ctx, call)
+	}
+	for finished := false; !finished; {
+		select {
+		case <-done:
+			finished = true
+		default:
+		}
+		require.NoError(t, server.SetMethodTimeout("Get", time.Second))
+		require.NoError(t, server.UseFor("Get", pass))
+		require.NoError(t, server.SetParamsSchema("Get", &rpcserver.Schema{Type: "object"}))
+		require.NoError(t, server.Describe("Get", &rpcserver.MethodDoc{Summary: "Gets the value"}))
+		require.NoError(t, server.SetMethodOptions("Get", &rpcserver.MethodOptions{Idempotent: true}))
+		require.NoError(t, server.SetAliases("Get", "get"))
+		require.NotEmpty(t, server.Discover().Methods)
+	}
+}
+
 type MockArgs struct {
 	A, B int
 }
@@ -175,6 +1596,8 @@ type MockRpcObject struct {
 	B      int
 	Result int
 	Err    error
+	Id     string
+	Method string
 	t      *testing.T
 }
 
@@ -210,3 +1633,99 @@ func (m *MockRpcObject) Action(r *http.Request, args *MockArgs, reply *MockReply
 	}
 	return nil
 }
+
+func (m *MockRpcObject) ActionContext(ctx context.Context, args *MockArgs, reply *MockReply) error {
+	m.Id = rpcserver.IdFromContext(ctx)
+	m.Method = rpcserver.MethodFromContext(ctx)
+	if rpcserver.RequestFromContext(ctx) == nil {
+		return errors.New("no request in context")
+	}
+	return m.Action(rpcserver.RequestFromContext(ctx), args, reply)
+}
+
+func (m *MockRpcObject) ActionReturn(ctx context.Context, args MockArgs) (MockReply, error) {
+	var reply MockReply
+	err := m.Action(rpcserver.RequestFromContext(ctx), &args, &reply)
+	return reply, err
+}
+
+func (m *MockRpcObject) ActionReturnPtr(r *http.Request, args *MockArgs) (*MockReply, error) {
+	reply := &MockReply{}
+	if err := m.Action(r, args, reply); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+func (m *MockRpcObject) ActionParams(ctx context.Context, name string, count int, flag bool) (string, error) {
+	return fmt.Sprintf("%v %v %v", name, count, flag), nil
+}
+
+func (m *MockRpcObject) ActionPanic(ctx context.Context, args *MockArgs) (*MockReply, error) {
+	if args.A != 0 {
+		panic("expected panic")
+	}
+	return &MockReply{}, nil
+}
+
+type MockSlowObject struct {
+	MaxRunning int32
+	Order      []int
+	running    int32
+	mu         sync.Mutex
+}
+
+func (m *MockSlowObject) Sleep(r *http.Request, args *MockArgs, reply *MockReply) error {
+	running := atomic.AddInt32(&m.running, 1)
+	defer atomic.AddInt32(&m.running, -1)
+	for {
+		max := atomic.LoadInt32(&m.MaxRunning)
+		if running <= max || atomic.CompareAndSwapInt32(&m.MaxRunning, max, running) {
+			break
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	m.mu.Lock()
+	m.Order = append(m.Order, args.A)
+	m.mu.Unlock()
+	reply.Value = args.A
+	return nil
+}
+
+type BenchArith struct{}
+
+func (b *BenchArith) Multiply(ctx context.Context, args *MockArgs, reply *MockReply) error {
+	reply.Value = args.A * args.B
+	return nil
+}
+
+func benchmarkServer(b *testing.B, server *rpcserver.Server, method string) {
+	server.RegisterCodec(jsonrpc2.NewCodec(), "application/json")
+	body := `{"jsonrpc": "2.0", "method": "` + method + `", "id":1, "params": {"A": 5, "B": 2}}`
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/jsonrpc/v1/"+method, strings.NewReader(body))
+		server.ServeHTTP(w, req)
+	}
+}
+
+func Benchmark_Reflect(b *testing.B) {
+	server, err := rpcserver.NewServer(nil)
+	require.NoError(b, err)
+	require.NoError(b, server.RegisterService(&BenchArith{}, "Arith"))
+	benchmarkServer(b, server, "Arith.Multiply")
+}
+
+func Benchmark_Handle(b *testing.B) {
+	server, err := rpcserver.NewServer(nil)
+	require.NoError(b, err)
+	arith := &BenchArith{}
+	err = rpcserver.Handle(server, "Arith.Multiply", func(ctx context.Context, args *MockArgs) (*MockReply, error) {
+		reply := new(MockReply)
+		return reply, arith.Multiply(ctx, args, reply)
+	})
+	require.NoError(b, err)
+	benchmarkServer(b, server, "Arith.Multiply")
+}
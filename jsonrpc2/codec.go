@@ -10,7 +10,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/datalinkE/rpcserver"
+	"io"
 	"net/http"
+	"reflect"
 )
 
 var null = json.RawMessage([]byte("null"))
@@ -61,8 +63,32 @@ type serverResponse struct {
 // ----------------------------------------------------------------------------
 
 // Codec creates a CodecRequest to process each request.
+//
+// If RespectNotifyMessages is set, notifications never get a response: the
+// server replies with 204 No Content and errors are not sent to the client.
+// Otherwise notifications are answered like other requests with null id.
+//
+// If Strict is set, requests with unknown fields, duplicate keys or data
+// after the request are rejected: E_INVALID_REQ is reported for the request
+// object and E_BAD_PARAMS for the params, with the path of the offending key
+// in the data. Params are checked against the args of the method.
+//
+// If UseNumber is set, numbers decoded into interface{} values of params are
+// json.Number instead of float64.
+//
+// If IntsAsStrings is set, int, int64, uint and uint64 values of results are
+// encoded as JSON strings and such params are accepted both as strings and as
+// numbers, so they don't lose precision in JavaScript clients. The same is
+// done for single fields by the string option of the json tag. The OpenRPC
+// document of rpc.discover describes these integers as strings.
+//
+// Limits protect the server from oversized or deeply nested bodies.
 type Codec struct {
 	RespectNotifyMessages bool
+	Strict                bool
+	UseNumber             bool
+	IntsAsStrings         bool
+	Limits                Limits
 }
 
 // NewCodec creates a Codec object.
@@ -77,30 +103,139 @@ func NewCodec() *Codec {
 // ----------------------------------------------------------------------------
 
 // NewRequest returns a CodecRequest. Decode the request body and check if RPC signature is valid.
+//
+// A body holding a JSON array is decoded as a batch, see
+// http://www.jsonrpc.org/specification#batch
 func (c *Codec) NewRequest(r *http.Request) rpcserver.CodecRequest {
+	defer r.Body.Close()
+	var raw json.RawMessage
+	var body io.Reader = r.Body
+	if c.Limits != (Limits{}) {
+		body = newLimitReader(r.Body, c.Limits)
+	}
+	dec := json.NewDecoder(body)
+	if err := dec.Decode(&raw); err != nil {
+		if errLimit := asLimitError(err); errLimit != nil {
+			return c.newCodecRequest(new(serverRequest), errLimit)
+		}
+		return c.newCodecRequest(new(serverRequest), NewError(E_PARSE, err.Error(), nil))
+	}
+	if c.Strict {
+		if err := checkTrailing(dec); err != nil {
+			return c.newCodecRequest(new(serverRequest), err)
+		}
+	}
+	if isArray(raw) {
+		return c.newBatchRequest(raw)
+	}
 	req := new(serverRequest)
-	err := json.NewDecoder(r.Body).Decode(req)
+	err := json.Unmarshal(raw, req)
 	if err != nil {
 		err = NewError(E_PARSE, err.Error(), req)
-	} else if req.Version != Version {
-		err = NewError(E_INVALID_REQ, "jsonrpc must be "+Version, req)
-	} else if req.Method == "" {
-		err = NewError(E_NO_METHOD, "method field empty or missing", req)
-	} else {
-		pathMethod := rpcserver.LastPart(r.URL.Path)
-		if pathMethod != req.Method {
-			err = NewError(E_NO_METHOD, fmt.Sprintf("rpc: URL.Path '%v' does not end with method Name '%v'", r.URL.Path, req.Method), req)
+	} else if c.Strict {
+		err = c.checkRequest(raw)
+	}
+	return c.newCodecRequest(req, err)
+}
+
+// newCodecRequest checks if RPC signature of the decoded request is valid.
+//
+// The method is not matched with the URL path, it is up to the server.
+func (c *Codec) newCodecRequest(req *serverRequest, err error) *CodecRequest {
+	if err == nil {
+		if req.Version != Version {
+			err = NewError(E_INVALID_REQ, "jsonrpc must be "+Version, req)
+		} else if req.Method == "" {
+			err = NewError(E_NO_METHOD, "method field empty or missing", req)
+		}
+	}
+	return &CodecRequest{
+		request:               req,
+		err:                   err,
+		respectNotifyMessages: c.RespectNotifyMessages,
+		strict:                c.Strict,
+		useNumber:             c.UseNumber,
+		intsAsStrings:         c.IntsAsStrings,
+		notification:          req.Id == nil && err == nil,
+	}
+}
+
+// checkRequest checks the request object in strict mode.
+func (c *Codec) checkRequest(raw json.RawMessage) error {
+	if v := checkStrict(raw, typeOfServerRequest, ""); v != nil {
+		return strictError(E_INVALID_REQ, v)
+	}
+	return nil
+}
+
+// newBatchRequest decodes every request of the batch.
+//
+// Requests which can't be decoded get an invalid request error with
+// null id, the rest of the batch is processed as usual.
+func (c *Codec) newBatchRequest(raw json.RawMessage) *CodecRequest {
+	batch := &CodecRequest{
+		request:               new(serverRequest),
+		respectNotifyMessages: c.RespectNotifyMessages,
+	}
+	var raws []json.RawMessage
+	if err := json.Unmarshal(raw, &raws); err != nil {
+		batch.err = NewError(E_PARSE, err.Error(), nil)
+		return batch
+	}
+	if len(raws) == 0 {
+		batch.err = NewError(E_INVALID_REQ, "empty batch", nil)
+		return batch
+	}
+	batch.requests = make([]rpcserver.CodecRequest, len(raws))
+	batch.responses = make([]*serverResponse, len(raws))
+	for i, rawReq := range raws {
+		req := new(serverRequest)
+		var err error
+		if errUnmarshal := json.Unmarshal(rawReq, req); errUnmarshal != nil {
+			req = new(serverRequest) // id is unknown, respond with null
+			err = NewError(E_INVALID_REQ, errUnmarshal.Error(), nil)
+		} else if c.Strict {
+			err = c.checkRequest(rawReq)
+		}
+		codecReq := c.newCodecRequest(req, err)
+		codecReq.batch = batch
+		codecReq.index = i
+		batch.requests[i] = codecReq
+	}
+	return batch
+}
+
+// isArray returns true if raw JSON value is an array.
+func isArray(raw json.RawMessage) bool {
+	for _, b := range raw {
+		switch b {
+		case ' ', '\t', '\r', '\n':
+			continue
+		case '[':
+			return true
 		}
+		return false
 	}
-	r.Body.Close()
-	return &CodecRequest{request: req, err: err, respectNotifyMessages: c.RespectNotifyMessages}
+	return false
 }
 
-// CodecRequest decodes and encodes a single request.
+// CodecRequest decodes and encodes a single request or a batch.
 type CodecRequest struct {
 	request               *serverRequest
 	err                   error
 	respectNotifyMessages bool
+	strict                bool
+	useNumber             bool
+	intsAsStrings         bool
+	notification          bool // valid request without id
+
+	// Set for a batch.
+	requests  []rpcserver.CodecRequest
+	responses []*serverResponse // indexed as requests, nil for notifications
+
+	// Set for a request from a batch.
+	batch *CodecRequest
+	index int
 }
 
 // Error returns if request was valid or incorrect.
@@ -108,6 +243,20 @@ func (c *CodecRequest) Error() error {
 	return c.err
 }
 
+// Id returns the request id as raw JSON, empty for notifications.
+func (c *CodecRequest) Id() string {
+	if c.request.Id == nil {
+		return ""
+	}
+	return string(*c.request.Id)
+}
+
+// IsNotification returns true if the request is a valid notification which
+// doesn't get a response.
+func (c *CodecRequest) IsNotification() bool {
+	return c.notification && (c.respectNotifyMessages || c.batch != nil)
+}
+
 // Method returns the RPC method for the current request.
 func (c *CodecRequest) Method() (string, error) {
 	if c.err == nil {
@@ -129,17 +278,52 @@ func (c *CodecRequest) Method() (string, error) {
 // absence of expected names MAY result in an error being
 // generated. The names MUST match exactly, including
 // case, to the method's expected parameters.
+//
+// Methods with several parameters get *rpcserver.Params as args. By-position
+// params are mapped on them element by element, by-name params are mapped
+// using the parameter names.
 func (c *CodecRequest) ReadRequest(args interface{}) error {
+	if params, ok := args.(*rpcserver.Params); ok {
+		if c.err == nil && c.request.Params != nil {
+			if c.strict {
+				if v := checkParams(*c.request.Params, params); v != nil {
+					c.err = strictError(E_BAD_PARAMS, v)
+					return c.err
+				}
+			}
+			c.err = c.readParams(params)
+		}
+		return c.err
+	}
+	if c.err == nil && c.request.Params != nil && c.strict {
+		t := reflect.TypeOf(args)
+		if ft := fieldsType(t); ft != nil && ft.Kind() != reflect.Slice && ft.Kind() != reflect.Array && isArray(*c.request.Params) {
+			t = reflect.ArrayOf(1, t) // args by position, see below
+		}
+		if v := checkStrict(*c.request.Params, t, ""); v != nil {
+			c.err = strictError(E_BAD_PARAMS, v)
+			return c.err
+		}
+	}
 	if c.err == nil && c.request.Params != nil {
 		// Note: if c.request.Params is nil it's not an error, it's an optional member.
 		// JSON params structured object. Unmarshal to the args object.
-		if err := json.Unmarshal(*c.request.Params, args); err != nil {
+		if err := c.unmarshal(*c.request.Params, args); err != nil {
+			if errInt := integerError(err, "", c.request.Params); errInt != nil {
+				c.err = errInt
+				return c.err
+			}
 			// Clearly JSON params is not a structured object,
 			// fallback and attempt an unmarshal with JSON params as
 			// array value and RPC params is struct. Unmarshal into
 			// array containing the request struct.
-			params := [1]interface{}{args}
-			if err = json.Unmarshal(*c.request.Params, &params); err != nil {
+			params := reflect.New(reflect.ArrayOf(1, reflect.TypeOf(args)))
+			params.Elem().Index(0).Set(reflect.ValueOf(args))
+			if err = c.unmarshal(*c.request.Params, params.Interface()); err != nil {
+				if errInt := integerError(err, "0.", c.request.Params); errInt != nil {
+					c.err = errInt
+					return c.err
+				}
 				c.err = &Error{
 					Code:    E_INVALID_REQ,
 					Message: err.Error(),
@@ -151,21 +335,91 @@ func (c *CodecRequest) ReadRequest(args interface{}) error {
 	return c.err
 }
 
+// readParams fills the parameters of a method with several parameters.
+func (c *CodecRequest) readParams(params *rpcserver.Params) error {
+	raw := *c.request.Params
+	if isArray(raw) {
+		var values []json.RawMessage
+		if err := json.Unmarshal(raw, &values); err != nil {
+			return NewError(E_BAD_PARAMS, err.Error(), c.request.Params)
+		}
+		if len(values) > len(params.Values) {
+			return NewError(E_BAD_PARAMS, fmt.Sprintf("too many params: %d, expected %d", len(values), len(params.Values)), c.request.Params)
+		}
+		for i, value := range values {
+			if err := c.unmarshal(value, params.Values[i]); err != nil {
+				return NewError(E_BAD_PARAMS, fmt.Sprintf("param %d: %v", i, err), c.request.Params)
+			}
+		}
+		return nil
+	}
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &values); err != nil {
+		return NewError(E_BAD_PARAMS, err.Error(), c.request.Params)
+	}
+	if params.Names == nil && len(values) > 0 {
+		return NewError(E_BAD_PARAMS, "params by name are not supported by method", c.request.Params)
+	}
+	for i, name := range params.Names {
+		value, ok := values[name]
+		if !ok {
+			continue
+		}
+		if err := c.unmarshal(value, params.Values[i]); err != nil {
+			return NewError(E_BAD_PARAMS, fmt.Sprintf("param %q: %v", name, err), c.request.Params)
+		}
+	}
+	return nil
+}
+
 // WriteResponse encodes the response and writes it to the ResponseWriter.
+//
+// A nil reply is sent as a null result, a response always has a result or an
+// error.
 func (c *CodecRequest) WriteResponse(w http.ResponseWriter, reply interface{}) {
+	if c.intsAsStrings {
+		if doc, ok := reply.(*rpcserver.OpenRPC); ok {
+			// The OpenRPC document is not a reply of a method, its numbers
+			// follow the specification.
+			reply = quoteDoc(doc)
+		} else {
+			reply = quoteInts(reflect.ValueOf(reply))
+		}
+	}
+	if reply == nil {
+		reply = null
+	}
 	res := &serverResponse{
 		Version: Version,
 		Result:  reply,
 		Id:      c.request.Id,
 	}
-	c.writeServerResponse(w, res)
+	c.writeServerResponse(w, http.StatusOK, res)
 }
 
+// WriteError encodes the error and writes it to the ResponseWriter.
+//
+// Errors other than *Error get the code from rpcserver.ErrorCode, panics are
+// reported as internal errors without the details.
 func (c *CodecRequest) WriteError(w http.ResponseWriter, status int, err error) {
-	jsonErr, ok := err.(*Error)
-	if !ok {
+	var jsonErr *Error
+	switch e := err.(type) {
+	case *Error:
+		jsonErr = e
+	case *rpcserver.Error:
+		jsonErr = &Error{
+			Code:    e.Code,
+			Message: e.Message,
+			Data:    e.Data,
+		}
+	case *rpcserver.PanicError:
+		jsonErr = &Error{
+			Code:    E_INTERNAL,
+			Message: "internal error",
+		}
+	default:
 		jsonErr = &Error{
-			Code:    status,
+			Code:    rpcserver.ErrorCode(err),
 			Message: err.Error(),
 		}
 	}
@@ -174,16 +428,60 @@ func (c *CodecRequest) WriteError(w http.ResponseWriter, status int, err error)
 		Error:   jsonErr,
 		Id:      c.request.Id,
 	}
-	c.writeServerResponse(w, res)
+	c.writeServerResponse(w, status, res)
+}
+
+// IsBatch returns true if the request is a valid batch.
+func (c *CodecRequest) IsBatch() bool {
+	return c.err == nil && c.requests != nil
 }
 
-func (c *CodecRequest) writeServerResponse(w http.ResponseWriter, res *serverResponse) {
+// Requests returns the requests of the batch.
+func (c *CodecRequest) Requests() []rpcserver.CodecRequest {
+	return c.requests
+}
+
+// WriteBatch writes the responses collected from the requests of the batch.
+//
+// Only 204 No Content is written if the batch consists of notifications.
+func (c *CodecRequest) WriteBatch(w http.ResponseWriter) {
+	responses := make([]*serverResponse, 0, len(c.responses))
+	for _, res := range c.responses {
+		if res != nil {
+			responses = append(responses, res)
+		}
+	}
+	if len(responses) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	encoder := json.NewEncoder(w)
+	err := encoder.Encode(responses)
+
+	if err != nil {
+		rpcserver.WriteError(w, 400, err.Error())
+	}
+}
+
+func (c *CodecRequest) writeServerResponse(w http.ResponseWriter, status int, res *serverResponse) {
+	// Responses from a batch are written all at once by WriteBatch.
+	if c.batch != nil {
+		if !c.IsNotification() {
+			c.batch.responses[c.index] = res
+		}
+		return
+	}
+
 	// Id is null for notifications and they don't have a response.
-	if c.request.Id == nil && c.respectNotifyMessages {
+	if c.IsNotification() {
+		w.WriteHeader(http.StatusNoContent)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
 	encoder := json.NewEncoder(w)
 	err := encoder.Encode(res)
 
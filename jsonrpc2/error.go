@@ -17,6 +17,7 @@ const (
 	E_BAD_PARAMS  = -32602
 	E_INTERNAL    = -32603
 	E_SERVER      = -32000
+	E_LIMIT       = -32002 // see rpcserver.CodeLimitExceeded
 )
 
 var ErrNullResult = errors.New("result is null")
@@ -44,3 +45,8 @@ func NewError(code int, msg string, data interface{}) error {
 func (e *Error) Error() string {
 	return e.Message
 }
+
+// ErrorCode returns the code of the error, see rpcserver.ErrorCode.
+func (e *Error) ErrorCode() int {
+	return e.Code
+}
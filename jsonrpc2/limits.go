@@ -0,0 +1,167 @@
+// Copyright 2017 Andrey Pichugin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package jsonrpc2
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ----------------------------------------------------------------------------
+// Limits
+// ----------------------------------------------------------------------------
+
+// Limits of the request body, zero values mean no limit.
+//
+// The body is checked while it is read, a request breaching a limit is
+// rejected with E_LIMIT before it is read to the end.
+type Limits struct {
+	MaxBodyBytes    int64 // size of the body
+	MaxDepth        int   // nesting of objects and arrays
+	MaxArrayLength  int   // elements of an array, except a batch
+	MaxStringLength int   // bytes of a string or a key as encoded, with escapes
+	MaxBatchSize    int   // requests in a batch
+}
+
+// limitError is returned by limitReader when a limit is breached.
+type limitError struct {
+	msg string
+}
+
+func (e *limitError) Error() string {
+	return e.msg
+}
+
+// asLimitError returns E_LIMIT if the error is caused by a breached limit.
+func asLimitError(err error) error {
+	var limitErr *limitError
+	if errors.As(err, &limitErr) {
+		return NewError(E_LIMIT, limitErr.msg, nil)
+	}
+	return nil
+}
+
+// limitReader scans the JSON read from r and fails when a limit is breached.
+//
+// It only tracks the structure of the JSON, syntax errors are left to the
+// decoder.
+type limitReader struct {
+	r      io.Reader
+	limits Limits
+	err    error
+
+	read      int64
+	inString  bool
+	escaped   bool
+	stringLen int
+	arrays    []*arrayState // nil for objects, from outermost
+}
+
+type arrayState struct {
+	length  int
+	pending bool // an element may start
+}
+
+func newLimitReader(r io.Reader, limits Limits) *limitReader {
+	return &limitReader{r: r, limits: limits}
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.err != nil {
+		return 0, l.err
+	}
+	if max := l.limits.MaxBodyBytes; max > 0 && int64(len(p)) > max-l.read+1 {
+		p = p[:max-l.read+1] // read a byte past the limit to detect it
+	}
+	n, err := l.r.Read(p)
+	for i := 0; i < n; i++ {
+		if l.err = l.scan(p[i]); l.err != nil {
+			return i, l.err
+		}
+	}
+	return n, err
+}
+
+func (l *limitReader) scan(b byte) error {
+	l.read++
+	if max := l.limits.MaxBodyBytes; max > 0 && l.read > max {
+		return &limitError{fmt.Sprintf("body exceeds %d bytes", max)}
+	}
+	if l.inString {
+		switch {
+		case l.escaped:
+			l.escaped = false
+		case b == '\\':
+			l.escaped = true
+		case b == '"':
+			l.inString = false
+			return nil
+		}
+		l.stringLen++
+		if max := l.limits.MaxStringLength; max > 0 && l.stringLen > max {
+			return &limitError{fmt.Sprintf("string exceeds %d bytes", max)}
+		}
+		return nil
+	}
+	switch b {
+	case ' ', '\t', '\r', '\n', ':':
+		return nil
+	case ',':
+		if array := l.top(); array != nil {
+			array.pending = true
+		}
+		return nil
+	case ']', '}':
+		if len(l.arrays) > 0 {
+			l.arrays = l.arrays[:len(l.arrays)-1]
+		}
+		return nil
+	}
+	// A value starts.
+	if err := l.countElement(); err != nil {
+		return err
+	}
+	switch b {
+	case '"':
+		l.inString = true
+		l.stringLen = 0
+	case '[', '{':
+		if max := l.limits.MaxDepth; max > 0 && len(l.arrays) >= max {
+			return &limitError{fmt.Sprintf("nesting exceeds depth %d", max)}
+		}
+		var array *arrayState
+		if b == '[' {
+			array = &arrayState{pending: true}
+		}
+		l.arrays = append(l.arrays, array)
+	}
+	return nil
+}
+
+// countElement counts the value starting in the innermost array.
+func (l *limitReader) countElement() error {
+	array := l.top()
+	if array == nil || !array.pending {
+		return nil
+	}
+	array.pending = false
+	array.length++
+	if len(l.arrays) == 1 {
+		if max := l.limits.MaxBatchSize; max > 0 && array.length > max {
+			return &limitError{fmt.Sprintf("batch exceeds %d requests", max)}
+		}
+	} else if max := l.limits.MaxArrayLength; max > 0 && array.length > max {
+		return &limitError{fmt.Sprintf("array exceeds %d elements", max)}
+	}
+	return nil
+}
+
+func (l *limitReader) top() *arrayState {
+	if len(l.arrays) == 0 {
+		return nil
+	}
+	return l.arrays[len(l.arrays)-1]
+}
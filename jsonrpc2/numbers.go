@@ -0,0 +1,417 @@
+// Copyright 2017 Andrey Pichugin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package jsonrpc2
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/datalinkE/rpcserver"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+var (
+	typeOfMarshaler     = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	typeOfTextMarshaler = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// ----------------------------------------------------------------------------
+// Numbers
+// ----------------------------------------------------------------------------
+
+// unmarshal decodes params into v following the options of the codec.
+//
+// encoding/json only decodes integers written without a fraction or an
+// exponent into integer types. If decoding fails on another notation of an
+// integer, as 1e3, the numbers are rewritten for the integer types which can
+// hold them and decoded again.
+func (c *CodecRequest) unmarshal(data []byte, v interface{}) error {
+	var err error
+	if c.intsAsStrings {
+		if data, err = rewriteNumbers(data, reflect.TypeOf(v), unquoteInt); err != nil {
+			return err
+		}
+	}
+	err = c.decode(data, v)
+	if typeErr, _ := asIntegerError(err); typeErr != nil {
+		if data, errRewrite := rewriteNumbers(data, reflect.TypeOf(v), normalizeInt); errRewrite == nil {
+			err = c.decode(data, v)
+		}
+	}
+	return err
+}
+
+func (c *CodecRequest) decode(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if c.useNumber {
+		dec.UseNumber()
+	}
+	return dec.Decode(v)
+}
+
+// asIntegerError returns the error of encoding/json for a number which can't
+// be decoded into an integer type, and the number.
+func asIntegerError(err error) (*json.UnmarshalTypeError, string) {
+	var typeErr *json.UnmarshalTypeError
+	if !errors.As(err, &typeErr) || !strings.HasPrefix(typeErr.Value, "number ") || !isIntKind(typeErr.Type) {
+		return nil, ""
+	}
+	return typeErr, strings.TrimPrefix(typeErr.Value, "number ")
+}
+
+// integerError returns E_BAD_PARAMS if the error is caused by a number which
+// can't be stored in an integer: one which is not an integer, or one out of
+// the range of the integer type. The prefix is trimmed from the path of the
+// field.
+func integerError(err error, prefix string, data interface{}) error {
+	typeErr, number := asIntegerError(err)
+	if typeErr == nil {
+		return nil
+	}
+	msg := fmt.Sprintf("%s is out of range for %s", number, typeErr.Type)
+	if f, ok := parseNumber(number); ok && !f.IsInf() && !f.IsInt() {
+		msg = fmt.Sprintf("%s is not an integer", number)
+	}
+	if field := strings.TrimPrefix(typeErr.Field, prefix); field != "" {
+		msg = field + ": " + msg
+	}
+	return NewError(E_BAD_PARAMS, msg, data)
+}
+
+// parseNumber returns the value of the JSON number. The precision keeps the
+// digits of the number, so a fraction is not rounded away.
+func parseNumber(number string) (*big.Float, bool) {
+	f, _, err := big.ParseFloat(number, 10, uint(4*len(number)+64), big.ToNearestEven)
+	return f, err == nil
+}
+
+// isIntKind returns true for the integer types.
+func isIntKind(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return true
+	}
+	return false
+}
+
+// isInt64 returns true for the integer types which may not fit in float64.
+func isInt64(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint64:
+		return true
+	}
+	return false
+}
+
+// fitsInt returns true if the number is an integer in the range of the
+// integer type.
+func fitsInt(f *big.Float, t reflect.Type) bool {
+	if f.IsInf() || !f.IsInt() {
+		return false
+	}
+	i, _ := f.Int(nil)
+	bits := uint(t.Bits())
+	switch t.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return i.Sign() >= 0 && i.BitLen() <= int(bits)
+	}
+	limit := new(big.Int).Lsh(big.NewInt(1), bits-1)
+	return i.Cmp(new(big.Int).Neg(limit)) >= 0 && i.Cmp(limit) < 0
+}
+
+// unquoteInt replaces a string holding a number with the number where it
+// goes to a 64-bit integer.
+func unquoteInt(value interface{}, t reflect.Type) interface{} {
+	if s, ok := value.(string); ok && isInt64(t) {
+		if _, err := strconv.ParseFloat(s, 64); err == nil {
+			return json.Number(s)
+		}
+	}
+	return value
+}
+
+// normalizeInt writes a number which goes to an integer type able to hold it
+// without a fraction or an exponent.
+func normalizeInt(value interface{}, t reflect.Type) interface{} {
+	if n, ok := value.(json.Number); ok && isIntKind(t) {
+		if f, ok := parseNumber(string(n)); ok && fitsInt(f, t) {
+			i, _ := f.Int(nil)
+			return json.Number(i.String())
+		}
+	}
+	return value
+}
+
+// rewriteNumbers decodes data with UseNumber, replaces the numbers and the
+// strings with the result of rewrite for the Go type they go to, and encodes
+// the value again.
+func rewriteNumbers(data []byte, t reflect.Type, rewrite func(value interface{}, t reflect.Type) interface{}) ([]byte, error) {
+	var value interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&value); err != nil {
+		return nil, err
+	}
+	return json.Marshal(rewriteValue(value, t, rewrite))
+}
+
+func rewriteValue(value interface{}, t reflect.Type, rewrite func(value interface{}, t reflect.Type) interface{}) interface{} {
+	t = fieldsType(t)
+	if t == nil || t == typeOfRawMessage {
+		return value
+	}
+	switch v := value.(type) {
+	case string, json.Number:
+		return rewrite(v, t)
+	case []interface{}:
+		if t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+			for i := range v {
+				v[i] = rewriteValue(v[i], t.Elem(), rewrite)
+			}
+		}
+	case map[string]interface{}:
+		switch t.Kind() {
+		case reflect.Struct:
+			fields := make(map[string]reflect.StructField)
+			addStructFields(fields, t)
+			for key := range v {
+				// Fields with the string option are decoded by encoding/json.
+				if field, ok := lookupField(fields, key); ok && !hasStringOption(field) {
+					v[key] = rewriteValue(v[key], field.Type, rewrite)
+				}
+			}
+		case reflect.Map:
+			for key := range v {
+				v[key] = rewriteValue(v[key], t.Elem(), rewrite)
+			}
+		}
+	}
+	return value
+}
+
+// quoteInts returns the value to encode instead of v, with 64-bit integers
+// replaced by strings. Values with their own encoding are left as they are.
+func quoteInts(v reflect.Value) interface{} {
+	if !v.IsValid() {
+		return nil
+	}
+	t := v.Type()
+	if t.Implements(typeOfMarshaler) || t.Implements(typeOfTextMarshaler) {
+		return v.Interface()
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return quoteInts(v.Elem())
+	case reflect.Int, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10)
+	case reflect.Uint, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10)
+	case reflect.Struct:
+		return quoteFields(nil, v)
+	case reflect.Map:
+		if v.IsNil() || t.Key().Kind() != reflect.String {
+			return v.Interface()
+		}
+		m := make(map[string]interface{}, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			m[iter.Key().String()] = quoteInts(iter.Value())
+		}
+		return m
+	case reflect.Slice:
+		if v.IsNil() || t.Elem().Kind() == reflect.Uint8 {
+			return v.Interface()
+		}
+		fallthrough
+	case reflect.Array:
+		s := make([]interface{}, v.Len())
+		for i := range s {
+			s[i] = quoteInts(v.Index(i))
+		}
+		return s
+	}
+	return v.Interface()
+}
+
+// quoteFields adds the fields of the struct as encoded by encoding/json,
+// including the ones of embedded structs.
+func quoteFields(object jsonObject, v reflect.Value) jsonObject {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		value := v.Field(i)
+		if field.Anonymous && name == "" {
+			embedded := value
+			if embedded.Kind() == reflect.Ptr {
+				if embedded.IsNil() {
+					continue
+				}
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				object = quoteFields(object, embedded)
+				continue
+			}
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		if hasOption(options, "omitempty") && isEmptyValue(value) {
+			continue
+		}
+		member := quoteInts(value)
+		if hasOption(options, "string") {
+			scalar := value
+			if scalar.Kind() == reflect.Ptr && !scalar.IsNil() {
+				scalar = scalar.Elem()
+			}
+			switch scalar.Kind() {
+			case reflect.Bool:
+				member = strconv.FormatBool(scalar.Bool())
+			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+				member = strconv.FormatInt(scalar.Int(), 10)
+			case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+				member = strconv.FormatUint(scalar.Uint(), 10)
+			case reflect.Float32, reflect.Float64:
+				member = strconv.FormatFloat(scalar.Float(), 'g', -1, scalar.Type().Bits())
+			case reflect.String:
+				quoted, _ := json.Marshal(scalar.String())
+				member = string(quoted)
+			}
+		}
+		object = append(object, jsonMember{name, member})
+	}
+	return object
+}
+
+// quoteDoc returns a copy of the OpenRPC document describing the 64-bit
+// integers as strings, as quoteInts encodes them.
+func quoteDoc(doc *rpcserver.OpenRPC) *rpcserver.OpenRPC {
+	quoted := *doc
+	quoted.Methods = make([]*rpcserver.OpenRPCMethod, len(doc.Methods))
+	for i, method := range doc.Methods {
+		m := *method
+		m.Params = make([]*rpcserver.ContentDescriptor, len(method.Params))
+		for j, param := range method.Params {
+			m.Params[j] = quoteDescriptor(param)
+		}
+		m.Result = quoteDescriptor(method.Result)
+		quoted.Methods[i] = &m
+	}
+	return &quoted
+}
+
+func quoteDescriptor(d *rpcserver.ContentDescriptor) *rpcserver.ContentDescriptor {
+	if d == nil {
+		return nil
+	}
+	quoted := *d
+	quoted.Schema = quoteSchema(d.Schema)
+	return &quoted
+}
+
+// quoteSchema returns a copy of the schema with the integers of the formats
+// int64 and uint64 described as strings.
+func quoteSchema(s *rpcserver.Schema) *rpcserver.Schema {
+	if s == nil {
+		return nil
+	}
+	quoted := *s
+	if s.Type == "integer" && (s.Format == "int64" || s.Format == "uint64") {
+		quoted.Type = "string"
+		quoted.Enum = nil
+		for _, value := range s.Enum {
+			quoted.Enum = append(quoted.Enum, fmt.Sprint(value))
+		}
+	}
+	if s.Properties != nil {
+		quoted.Properties = make(map[string]*rpcserver.Schema, len(s.Properties))
+		for name, property := range s.Properties {
+			quoted.Properties[name] = quoteSchema(property)
+		}
+	}
+	quoted.Items = quoteSchema(s.Items)
+	quoted.AdditionalProperties = quoteSchema(s.AdditionalProperties)
+	return &quoted
+}
+
+// isEmptyValue returns true for the values omitted with omitempty.
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64,
+		reflect.Interface, reflect.Ptr:
+		return v.IsZero()
+	}
+	return false
+}
+
+// hasStringOption returns true if the field has the string option of the
+// json tag.
+func hasStringOption(field reflect.StructField) bool {
+	_, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+	return hasOption(options, "string")
+}
+
+func hasOption(options string, option string) bool {
+	for _, o := range strings.Split(options, ",") {
+		if o == option {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonObject is encoded as a JSON object keeping the order of members.
+type jsonObject []jsonMember
+
+type jsonMember struct {
+	name  string
+	value interface{}
+}
+
+func (o jsonObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, member := range o {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, err := json.Marshal(member.name)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(member.value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,255 @@
+// Copyright 2017 Andrey Pichugin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package jsonrpc2
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"github.com/datalinkE/rpcserver"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	typeOfRawMessage      = reflect.TypeOf(json.RawMessage{})
+	typeOfServerRequest   = reflect.TypeOf(serverRequest{})
+	typeOfUnmarshaler     = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	typeOfTextUnmarshaler = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// ----------------------------------------------------------------------------
+// Strict mode
+// ----------------------------------------------------------------------------
+
+// strictError returns the error for the violation found in strict mode.
+func strictError(code int, v *rpcserver.Violation) error {
+	return NewError(code, fmt.Sprintf("%s %q", v.Message, v.Field), []*rpcserver.Violation{v})
+}
+
+// checkTrailing returns an error if anything but white space follows the
+// value read by the decoder.
+func checkTrailing(dec *json.Decoder) error {
+	if _, err := dec.Token(); err != io.EOF {
+		if errLimit := asLimitError(err); errLimit != nil {
+			return errLimit
+		}
+		return NewError(E_INVALID_REQ, "trailing data after request", nil)
+	}
+	return nil
+}
+
+// checkStrict returns the first duplicate key of the JSON value, or the first
+// key which doesn't match a field of the Go type t. Only duplicates are
+// looked for if t is nil.
+//
+// Fields match the keys as in encoding/json, case-insensitively.
+func checkStrict(raw json.RawMessage, t reflect.Type, path string) *rpcserver.Violation {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	return checkValue(dec, t, path)
+}
+
+func checkValue(dec *json.Decoder, t reflect.Type, path string) *rpcserver.Violation {
+	t = fieldsType(t)
+	if t == typeOfRawMessage {
+		// Opaque, checked by the code decoding it.
+		var skip json.RawMessage
+		if err := dec.Decode(&skip); err != nil {
+			return &rpcserver.Violation{Field: path, Message: err.Error()}
+		}
+		return nil
+	}
+	tok, err := dec.Token()
+	if err != nil {
+		return &rpcserver.Violation{Field: path, Message: err.Error()}
+	}
+	switch tok {
+	case json.Delim('{'):
+		return checkObject(dec, t, path)
+	case json.Delim('['):
+		var elem reflect.Type
+		if t != nil && (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) {
+			elem = t.Elem()
+		}
+		for i := 0; dec.More(); i++ {
+			elemPath := fmt.Sprintf("%s[%d]", path, i)
+			if t != nil && t.Kind() == reflect.Array && i >= t.Len() {
+				return &rpcserver.Violation{Field: elemPath, Message: "unexpected element"}
+			}
+			if v := checkValue(dec, elem, elemPath); v != nil {
+				return v
+			}
+		}
+		if _, err := dec.Token(); err != nil {
+			return &rpcserver.Violation{Field: path, Message: err.Error()}
+		}
+	}
+	return nil
+}
+
+func checkObject(dec *json.Decoder, t reflect.Type, path string) *rpcserver.Violation {
+	var fields map[string]reflect.StructField
+	var elem reflect.Type
+	if t != nil {
+		switch t.Kind() {
+		case reflect.Struct:
+			fields = make(map[string]reflect.StructField)
+			addStructFields(fields, t)
+		case reflect.Map:
+			elem = t.Elem()
+		}
+	}
+	seen := make(map[string]bool)
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return &rpcserver.Violation{Field: path, Message: err.Error()}
+		}
+		key := tok.(string)
+		keyPath := joinPath(path, key)
+		if seen[key] {
+			return &rpcserver.Violation{Field: keyPath, Message: "duplicate key"}
+		}
+		seen[key] = true
+		valueType := elem
+		if fields != nil {
+			field, ok := lookupField(fields, key)
+			if !ok {
+				return &rpcserver.Violation{Field: keyPath, Message: "unknown field"}
+			}
+			valueType = field.Type
+		}
+		if v := checkValue(dec, valueType, keyPath); v != nil {
+			return v
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return &rpcserver.Violation{Field: path, Message: err.Error()}
+	}
+	return nil
+}
+
+// fieldsType returns the type to check the keys of the value against, nil
+// if any keys are accepted.
+func fieldsType(t reflect.Type) reflect.Type {
+	if t == nil {
+		return nil
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == typeOfRawMessage {
+		return t
+	}
+	ptr := reflect.PtrTo(t)
+	if t.Kind() == reflect.Interface || ptr.Implements(typeOfUnmarshaler) || ptr.Implements(typeOfTextUnmarshaler) {
+		return nil
+	}
+	return t
+}
+
+// addStructFields adds the fields of the struct as named by encoding/json,
+// including the ones of embedded structs.
+func addStructFields(fields map[string]reflect.StructField, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if field.Anonymous && name == "" {
+			embedded := field.Type
+			if embedded.Kind() == reflect.Ptr {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				addStructFields(fields, embedded)
+				continue
+			}
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields[name] = field
+	}
+}
+
+func lookupField(fields map[string]reflect.StructField, key string) (reflect.StructField, bool) {
+	if field, ok := fields[key]; ok {
+		return field, true
+	}
+	for name, field := range fields {
+		if strings.EqualFold(name, key) {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+func joinPath(path string, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// checkParams checks the params of a method with several parameters.
+func checkParams(raw json.RawMessage, params *rpcserver.Params) *rpcserver.Violation {
+	if isArray(raw) {
+		var values []json.RawMessage
+		if err := json.Unmarshal(raw, &values); err != nil {
+			return nil // reported when decoding
+		}
+		for i, value := range values {
+			if i >= len(params.Values) {
+				break
+			}
+			if v := checkStrict(value, reflect.TypeOf(params.Values[i]), paramName(params, i)); v != nil {
+				return v
+			}
+		}
+		return nil
+	}
+	if v := checkStrict(raw, nil, ""); v != nil {
+		return v
+	}
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &values); err != nil {
+		return nil
+	}
+	for i := range params.Values {
+		name := paramName(params, i)
+		if value, ok := values[name]; ok {
+			if v := checkStrict(value, reflect.TypeOf(params.Values[i]), name); v != nil {
+				return v
+			}
+			delete(values, name)
+		}
+	}
+	if len(values) > 0 {
+		names := make([]string, 0, len(values))
+		for name := range values {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return &rpcserver.Violation{Field: names[0], Message: "unknown field"}
+	}
+	return nil
+}
+
+func paramName(params *rpcserver.Params, i int) string {
+	if params.Names != nil {
+		return params.Names[i]
+	}
+	return strconv.Itoa(i)
+}
@@ -0,0 +1,221 @@
+package rpcserver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"reflect"
+	"sync"
+)
+
+// ----------------------------------------------------------------------------
+// Lifecycle
+// ----------------------------------------------------------------------------
+
+// Initializer may be implemented by a receiver to be initialized when it is
+// registered. The receiver is not registered if Init returns an error.
+//
+// Init gets the context given to RegisterServiceContext or
+// ReplaceServiceContext, context.Background() otherwise. It runs once for a
+// receiver registered under several names.
+type Initializer interface {
+	Init(ctx context.Context) error
+}
+
+// Stopper may be implemented by a receiver to be stopped by Shutdown, as an
+// alternative to io.Closer.
+type Stopper interface {
+	Stop()
+}
+
+// hookInterfaces are the receiver interfaces used by the server, their
+// methods are not RPC methods.
+var hookInterfaces = []reflect.Type{
+	reflect.TypeOf((*Describer)(nil)).Elem(),
+	reflect.TypeOf((*Initializer)(nil)).Elem(),
+	reflect.TypeOf((*io.Closer)(nil)).Elem(),
+	reflect.TypeOf((*Stopper)(nil)).Elem(),
+}
+
+// isHookMethod returns true if the method of the receiver type implements
+// one of hookInterfaces.
+func isHookMethod(rcvrType reflect.Type, name string) bool {
+	for _, hook := range hookInterfaces {
+		if hook.Method(0).Name == name && rcvrType.Implements(hook) {
+			return true
+		}
+	}
+	return false
+}
+
+// initReceiver calls the Init hook of the receiver.
+func initReceiver(ctx context.Context, receiver interface{}) error {
+	if initializer, ok := receiver.(Initializer); ok {
+		return initializer.Init(ctx)
+	}
+	return nil
+}
+
+// stopReceiver calls the Close or Stop hook of the receiver.
+func stopReceiver(receiver interface{}) error {
+	switch r := receiver.(type) {
+	case io.Closer:
+		return r.Close()
+	case Stopper:
+		r.Stop()
+	}
+	return nil
+}
+
+// addReceiver initializes the receiver and registers it with change, see
+// update.
+//
+// Init runs once per receiver, before the registry is locked, so it may
+// register methods too. A receiver added for the first time is stopped if it
+// can't be registered, unless it got registered under another name meanwhile.
+func (s *Server) addReceiver(ctx context.Context, receiver interface{}, change func(reg *registry) error) error {
+	first, err := s.lifecycle.initOnce(ctx, receiver)
+	if err != nil {
+		return err
+	}
+	if err := s.update(change); err != nil {
+		if first && !s.isRegistered(receiver) {
+			s.lifecycle.forget(receiver)
+			stopReceiver(receiver)
+		}
+		return err
+	}
+	return nil
+}
+
+// isRegistered returns true if a service of the server has the receiver.
+func (s *Server) isRegistered(receiver interface{}) bool {
+	t := reflect.TypeOf(receiver)
+	if !t.Comparable() {
+		return false
+	}
+	for _, service := range s.registry.Load().services {
+		if service.rcvrType == t && service.rcvr.Interface() == receiver {
+			return true
+		}
+	}
+	return false
+}
+
+// lifecycle tracks the receivers and the running calls until Shutdown.
+type lifecycle struct {
+	mu        sync.Mutex
+	shutdown  bool
+	calls     sync.WaitGroup       // requests, and calls running after them
+	receivers map[interface{}]bool // added receivers of comparable types
+}
+
+// initOnce calls the Init hook of the receiver if it is added for the first
+// time, which it returns. Receivers of types which are not comparable are
+// always new.
+func (l *lifecycle) initOnce(ctx context.Context, receiver interface{}) (bool, error) {
+	if reflect.TypeOf(receiver).Comparable() {
+		l.mu.Lock()
+		added := l.receivers[receiver]
+		if !added {
+			if l.receivers == nil {
+				l.receivers = make(map[interface{}]bool)
+			}
+			l.receivers[receiver] = true
+		}
+		l.mu.Unlock()
+		if added {
+			return false, nil
+		}
+	}
+	if err := initReceiver(ctx, receiver); err != nil {
+		l.forget(receiver)
+		return false, err
+	}
+	return true, nil
+}
+
+// forget makes the receiver new again, see initOnce.
+func (l *lifecycle) forget(receiver interface{}) {
+	if reflect.TypeOf(receiver).Comparable() {
+		l.mu.Lock()
+		delete(l.receivers, receiver)
+		l.mu.Unlock()
+	}
+}
+
+// begin counts a request, it returns false if the server is shutting down.
+func (l *lifecycle) begin() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.shutdown {
+		return false
+	}
+	l.calls.Add(1)
+	return true
+}
+
+// errShuttingDown is the error of requests received during Shutdown.
+var errShuttingDown = &Error{Code: CodeShuttingDown, Message: "server shutting down"}
+
+// Shutdown stops the server gracefully.
+//
+// New requests get an error with CodeShuttingDown. Shutdown waits for the
+// running calls to return, including async notifications and calls which
+// timed out, then stops the registered receivers implementing io.Closer or
+// Stopper and returns the errors of Close.
+//
+// If ctx is done first, Shutdown returns its error without stopping the
+// receivers.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.lifecycle.mu.Lock()
+	s.lifecycle.shutdown = true
+	s.lifecycle.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		s.lifecycle.calls.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	var errs []error
+	stopped := make(map[interface{}]bool)
+	for _, service := range s.registry.Load().services {
+		if !service.rcvr.IsValid() {
+			continue // methods registered with Handle
+		}
+		receiver := service.rcvr.Interface()
+		if service.rcvrType.Comparable() {
+			if stopped[receiver] {
+				continue
+			}
+			stopped[receiver] = true
+		}
+		if err := stopReceiver(receiver); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// serveShutdown answers the request with errShuttingDown.
+func (s *Server) serveShutdown(w http.ResponseWriter, codecReq CodecRequest) {
+	if batch, ok := codecReq.(BatchCodecRequest); ok && batch.IsBatch() {
+		for _, req := range batch.Requests() {
+			s.writeError(w, req, errShuttingDown)
+		}
+		batch.WriteBatch(w)
+		return
+	}
+	if err := codecReq.Error(); err != nil {
+		s.writeError(w, codecReq, err)
+		return
+	}
+	s.writeError(w, codecReq, errShuttingDown)
+}
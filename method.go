@@ -4,9 +4,11 @@ import (
 	"strings"
 )
 
+// PathHasMethod returns true if the path ends with the method name.
+//
+// Method names may contain slashes, as in "$/cancelRequest".
 func PathHasMethod(path string, method string) bool {
-	pathLastPart := LastPart(path)
-	return pathLastPart == method
+	return path == method || strings.HasSuffix(path, "/"+method)
 }
 
 func LastPart(path string) string {
@@ -0,0 +1,139 @@
+package rpcserver
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+)
+
+// ----------------------------------------------------------------------------
+// Names
+// ----------------------------------------------------------------------------
+
+// NameMapper returns the name a method of the service is called by. The
+// service name is empty for the default service.
+//
+// The methods of the server setting up a single method take the name made by
+// the mapper set with SetNameMapper, as in "Service.Method" by default, or an
+// alias of it, see SetAliases.
+type NameMapper func(service string, method string) string
+
+// DottedNames names methods as "Service.Method", or "Method" for the default
+// service. It is the default mapper.
+func DottedNames(service string, method string) string {
+	return joinName(service, ".", method)
+}
+
+// UnderscoreNames names methods as "Service_Method", or "Method" for the
+// default service.
+func UnderscoreNames(service string, method string) string {
+	return joinName(service, "_", method)
+}
+
+func joinName(service string, sep string, method string) string {
+	if service == "" {
+		return method
+	}
+	return service + sep + method
+}
+
+// LowerCamel converts the names to lowerCamelCase before joining them with
+// the mapper, e.g. "HTTPServer.GetID" becomes "httpServer.getId" with
+// DottedNames.
+func LowerCamel(mapper NameMapper) NameMapper {
+	return func(service string, method string) string {
+		return mapper(lowerCamel(service), lowerCamel(method))
+	}
+}
+
+// SnakeCase converts the names to snake_case before joining them with the
+// mapper, e.g. "Arith.MultiplyAll" becomes "arith_multiply_all" with
+// UnderscoreNames.
+func SnakeCase(mapper NameMapper) NameMapper {
+	return func(service string, method string) string {
+		return mapper(snakeCase(service), snakeCase(method))
+	}
+}
+
+// words splits a CamelCase or snake_case name into words, keeping acronyms
+// together.
+func words(name string) []string {
+	var result []string
+	var word []rune
+	runes := []rune(name)
+	for i, r := range runes {
+		if r == '_' {
+			result = append(result, string(word))
+			word = nil
+			continue
+		}
+		if unicode.IsUpper(r) && len(word) > 0 {
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if !unicode.IsUpper(runes[i-1]) || nextLower {
+				result = append(result, string(word))
+				word = nil
+			}
+		}
+		word = append(word, r)
+	}
+	return append(result, string(word))
+}
+
+func lowerCamel(name string) string {
+	var b strings.Builder
+	for _, word := range words(name) {
+		runes := []rune(strings.ToLower(word))
+		if len(runes) > 0 && b.Len() > 0 {
+			runes[0] = unicode.ToUpper(runes[0])
+		}
+		b.WriteString(string(runes))
+	}
+	return b.String()
+}
+
+func snakeCase(name string) string {
+	var parts []string
+	for _, word := range words(name) {
+		if word != "" {
+			parts = append(parts, strings.ToLower(word))
+		}
+	}
+	return strings.Join(parts, "_")
+}
+
+// SetNameMapper sets how the names of methods are made, see NameMapper.
+//
+// Methods are called and configured, e.g. with SetParamNames, by the mapped
+// names, which HasMethod and DiscoverMethod report. It returns an error if
+// two methods get the same name or the mapper is nil, the mapper is not
+// changed then.
+func (s *Server) SetNameMapper(mapper NameMapper) error {
+	if mapper == nil {
+		return errors.New("rpc: nil name mapper")
+	}
+	return s.update(func(reg *registry) error {
+		reg.nameMapper = mapper
+		return nil
+	})
+}
+
+// SetAliases sets other names the method may be called by, in addition to
+// the one made by the NameMapper. Aliases are not reported by DiscoverMethod.
+func (s *Server) SetAliases(method string, aliases ...string) error {
+	return s.updateMethod(method, func(methodSpec *RpcServiceMethod) error {
+		methodSpec.aliases = aliases
+		return nil
+	})
+}
+
+// hasNamespace returns true if the services include one whose methods are
+// named as the ones of the given service.
+func (s *Server) hasNamespace(service string) bool {
+	reg := s.registry.Load()
+	for name := range reg.services {
+		if name != "" && reg.nameMapper(name, "Method") == reg.nameMapper(service, "Method") {
+			return true
+		}
+	}
+	return false
+}
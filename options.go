@@ -0,0 +1,193 @@
+package rpcserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// Method options
+// ----------------------------------------------------------------------------
+
+// MethodOptions are the options of a method enforced or published by the
+// server.
+type MethodOptions struct {
+	Description string        // published by DiscoverMethod
+	Deprecated  bool          // published by DiscoverMethod
+	Permissions []string      // required, see SetPermissionChecker
+	Timeout     time.Duration // as set with SetMethodTimeout, if not 0
+	RateLimit   float64       // calls per second, 0 means no limit
+	Hidden      bool          // not published by DiscoverMethod
+	Idempotent  bool          // safe to retry, published by DiscoverMethod
+}
+
+// Describer may be implemented by a receiver to set the options of its
+// methods, keyed by the Go method names. Nil options are the same as none.
+type Describer interface {
+	DescribeMethods() map[string]*MethodOptions
+}
+
+// PermissionChecker returns an error if the call in the context may not use
+// the permissions required by the method. Errors without a code are sent with
+// CodePermissionDenied.
+type PermissionChecker func(ctx context.Context, permissions []string) error
+
+// SetMethodOptions sets the options of the method, as a Describer does for
+// the methods of a receiver. Nil clears the options. The method is named as
+// described by NameMapper.
+func (s *Server) SetMethodOptions(method string, options *MethodOptions) error {
+	return s.updateMethod(method, func(methodSpec *RpcServiceMethod) error {
+		methodSpec.setOptions(options)
+		return nil
+	})
+}
+
+// SetPermissionChecker sets the checker of the permissions required by the
+// methods, see MethodOptions.
+//
+// Calls of methods which require permissions are denied if there is no
+// checker.
+func (s *Server) SetPermissionChecker(checker PermissionChecker) {
+	s.permissionChecker = checker
+}
+
+// permissionError converts an error of the PermissionChecker. Errors without
+// a code deny the call with CodePermissionDenied, their message is not sent
+// with ErrorsProduction. Others are sent as errors of the method, see
+// sanitizeError.
+func (s *Server) permissionError(ctx context.Context, err error) error {
+	var coder ErrorCoder
+	if _, mapped := s.mappedCode(err); !mapped && !errors.As(err, &coder) {
+		message := err.Error()
+		if s.errorMode == ErrorsProduction {
+			message = "permission denied"
+		}
+		return &Error{Code: CodePermissionDenied, Message: message}
+	}
+	return s.sanitizeError(MethodFromContext(ctx), err)
+}
+
+// setOptions sets the options of the method, nil clears them.
+func (m *RpcServiceMethod) setOptions(options *MethodOptions) {
+	if m.options != nil && m.options.Timeout != 0 && m.timeout == m.options.Timeout {
+		m.timeout = 0 // set by the old options
+	}
+	m.options = options
+	m.limiter = nil
+	if options == nil {
+		return
+	}
+	if options.Timeout != 0 {
+		m.timeout = options.Timeout
+	}
+	if options.RateLimit > 0 {
+		m.limiter = newRateLimiter(options.RateLimit)
+	}
+}
+
+// checkOptions returns an error if the options of the method don't allow
+// the call.
+func (s *Server) checkOptions(ctx context.Context, methodSpec *RpcServiceMethod) error {
+	if methodSpec.options == nil {
+		return nil
+	}
+	if permissions := methodSpec.options.Permissions; len(permissions) > 0 {
+		if s.permissionChecker == nil {
+			return &Error{Code: CodePermissionDenied, Message: "permission denied"}
+		}
+		if err := s.permissionChecker(ctx, permissions); err != nil {
+			return s.permissionError(ctx, err)
+		}
+	}
+	if methodSpec.limiter != nil && !methodSpec.limiter.allow() {
+		return &Error{Code: CodeRateLimited, Message: "rate limit exceeded"}
+	}
+	return nil
+}
+
+// ----------------------------------------------------------------------------
+// Skipped methods
+// ----------------------------------------------------------------------------
+
+// SkippedMethod is an exported method of a receiver which is not an RPC
+// method, because it is not of suitable type.
+type SkippedMethod struct {
+	Service string // name of the service, "" for the default one
+	Method  string // Go name of the method
+	Reason  string // why it is not suitable
+}
+
+// SkippedMethods returns the exported methods of the registered receivers
+// which are not of suitable type, see NewServer.
+func (s *Server) SkippedMethods() []*SkippedMethod {
+	var skipped []*SkippedMethod
+	for serviceName, service := range s.registry.Load().services {
+		for methodName, reason := range service.skipped {
+			skipped = append(skipped, &SkippedMethod{
+				Service: serviceName,
+				Method:  methodName,
+				Reason:  reason,
+			})
+		}
+	}
+	sort.Slice(skipped, func(i, j int) bool {
+		if skipped[i].Service != skipped[j].Service {
+			return skipped[i].Service < skipped[j].Service
+		}
+		return skipped[i].Method < skipped[j].Method
+	})
+	return skipped
+}
+
+func (m *SkippedMethod) String() string {
+	return fmt.Sprintf("%s.%s: %s", m.Service, m.Method, m.Reason)
+}
+
+// ----------------------------------------------------------------------------
+// Rate limit
+// ----------------------------------------------------------------------------
+
+// rateLimiter is a token bucket refilled at rate tokens per second, holding
+// up to one second of tokens.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64) *rateLimiter {
+	return &rateLimiter{
+		rate:   rate,
+		tokens: burst(rate),
+		last:   time.Now(),
+	}
+}
+
+// allow takes a token if there is one.
+func (l *rateLimiter) allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if max := burst(l.rate); l.tokens > max {
+		l.tokens = max
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+func burst(rate float64) float64 {
+	if rate < 1 {
+		return 1
+	}
+	return rate
+}
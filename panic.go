@@ -0,0 +1,45 @@
+package rpcserver
+
+import (
+	"context"
+	"fmt"
+	"log"
+)
+
+// ----------------------------------------------------------------------------
+// Panic
+// ----------------------------------------------------------------------------
+
+// PanicError is the error of a call which panicked.
+//
+// Codecs should report it as an internal error without the details.
+type PanicError struct {
+	Value interface{} // value passed to panic
+	Stack []byte      // stack trace of the panicking goroutine
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("rpc: panic: %v", e.Value)
+}
+
+// ErrorCode returns CodeInternalError.
+func (e *PanicError) ErrorCode() int {
+	return CodeInternalError
+}
+
+// PanicHandler is called when a call panics, e.g. to report it.
+type PanicHandler func(ctx context.Context, call *Call, err *PanicError)
+
+// SetPanicHandler sets the handler of panics in service methods and
+// interceptors. By default the panic and its stack trace are logged, nil
+// disables the reporting.
+//
+// The panic is recovered either way and the client gets an internal error.
+func (s *Server) SetPanicHandler(handler PanicHandler) {
+	s.panicHandler = handler
+}
+
+// logPanic is the default PanicHandler.
+func logPanic(ctx context.Context, call *Call, err *PanicError) {
+	log.Printf("rpc: method %q panicked: %v\n%s", call.Method, err.Value, err.Stack)
+}
@@ -0,0 +1,222 @@
+package rpcserver
+
+import (
+	"context"
+	"fmt"
+)
+
+// ----------------------------------------------------------------------------
+// Registry
+// ----------------------------------------------------------------------------
+
+// registry holds the codecs and the services of the server.
+//
+// A stored registry is never changed: changes are made to a copy which
+// replaces it, see Server.update. Requests keep the services they got from
+// the registry, so running calls finish with the replaced implementations.
+type registry struct {
+	codecs     map[string]Codec
+	services   map[string]*RpcService // keyed by service name, "" is the default one
+	nameMapper NameMapper             // names of the methods called by clients
+	names      map[string]methodRef   // methods by names and aliases
+}
+
+// methodRef is a method registered under a name.
+type methodRef struct {
+	name        string // made by the NameMapper, differs from the key for aliases
+	serviceName string // key in services
+	methodName  string // key in the methods of the service
+	service     *RpcService
+	method      *RpcServiceMethod
+}
+
+// update changes a copy of the registry which replaces the current one if
+// change succeeds and the methods still have unique names.
+func (s *Server) update(change func(reg *registry) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old := s.registry.Load()
+	reg := &registry{
+		codecs:     make(map[string]Codec, len(old.codecs)),
+		services:   make(map[string]*RpcService, len(old.services)),
+		nameMapper: old.nameMapper,
+		names:      old.names, // made again after the change
+	}
+	for contentType, codec := range old.codecs {
+		reg.codecs[contentType] = codec
+	}
+	for name, service := range old.services {
+		reg.services[name] = service
+	}
+	if err := change(reg); err != nil {
+		return err
+	}
+	if err := reg.index(); err != nil {
+		return err
+	}
+	s.registry.Store(reg)
+	return nil
+}
+
+// updateMethod changes a copy of the method registered under the name, see
+// update. The services and methods stored in a registry are shared with the
+// requests using it, so they are never changed in place.
+func (s *Server) updateMethod(method string, change func(methodSpec *RpcServiceMethod) error) error {
+	return s.update(func(reg *registry) error {
+		ref, err := reg.lookup(method)
+		if err != nil {
+			return err
+		}
+		methodSpec := *ref.method
+		if err := change(&methodSpec); err != nil {
+			return err
+		}
+		service := reg.services[ref.serviceName].clone()
+		service.methods[ref.methodName] = &methodSpec
+		reg.services[ref.serviceName] = service
+		return nil
+	})
+}
+
+// lookup returns the method registered under the given name.
+//
+// The error has CodeMethodNotFound if there is no such method.
+func (reg *registry) lookup(method string) (methodRef, error) {
+	ref, ok := reg.names[method]
+	if !ok {
+		return ref, &Error{
+			Code:    CodeMethodNotFound,
+			Message: fmt.Sprintf("rpc: can't find method %q", method),
+		}
+	}
+	return ref, nil
+}
+
+// index maps the names of all methods and aliases to the methods.
+func (reg *registry) index() error {
+	reg.names = make(map[string]methodRef)
+	add := func(name string, ref methodRef) error {
+		if _, ok := reg.names[name]; ok {
+			return fmt.Errorf("rpc: method name used twice: %q", name)
+		}
+		reg.names[name] = ref
+		return nil
+	}
+	for serviceName, service := range reg.services {
+		for methodName, methodSpec := range service.methods {
+			ref := methodRef{
+				name:        reg.nameMapper(serviceName, methodName),
+				serviceName: serviceName,
+				methodName:  methodName,
+				service:     service,
+				method:      methodSpec,
+			}
+			if err := add(ref.name, ref); err != nil {
+				return err
+			}
+			for _, alias := range methodSpec.aliases {
+				if err := add(alias, ref); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// clone returns a copy of the service which can be changed.
+func (service *RpcService) clone() *RpcService {
+	c := *service
+	c.methods = make(map[string]*RpcServiceMethod, len(service.methods))
+	for name, m := range service.methods {
+		c.methods[name] = m
+	}
+	return &c
+}
+
+// UnregisterService removes the service registered with the name, "" is the
+// default service.
+//
+// Calls of the service which are running are not affected. The receiver is
+// not stopped, see Shutdown.
+func (s *Server) UnregisterService(name string) error {
+	return s.update(func(reg *registry) error {
+		if reg.services[name] == nil {
+			return fmt.Errorf("rpc: can't find service %q", name)
+		}
+		delete(reg.services, name)
+		return nil
+	})
+}
+
+// ReplaceService replaces the receiver of the service registered with the
+// name, "" is the default service.
+//
+// Calls of the service which are running finish with the old receiver, new
+// calls go to the new one. The old receiver is not stopped, the new one is
+// initialized as in RegisterService.
+//
+// The methods added to the service with Handle are kept. The settings of the
+// old methods, e.g. made with SetMethodTimeout or SetAliases, are kept for the
+// methods of the new receiver with the same names, except the options set by
+// a Describer of the new receiver. It returns an error if a setting can't be
+// kept, the service is not replaced then.
+func (s *Server) ReplaceService(receiver interface{}, name string) error {
+	return s.ReplaceServiceContext(context.Background(), receiver, name)
+}
+
+// ReplaceServiceContext is ReplaceService with the context given to the Init
+// hook of the receiver, see Initializer.
+func (s *Server) ReplaceServiceContext(ctx context.Context, receiver interface{}, name string) error {
+	service, err := NewRpcService(receiver)
+	if err != nil {
+		return err
+	}
+	return s.addReceiver(ctx, receiver, func(reg *registry) error {
+		old := reg.services[name]
+		if old == nil {
+			return fmt.Errorf("rpc: can't find service %q", name)
+		}
+		service.name = old.name
+		service.sequential = old.sequential
+		for methodName, oldMethod := range old.methods {
+			m := service.methods[methodName]
+			switch {
+			case oldMethod.handler != nil && m != nil:
+				return fmt.Errorf("rpc: method %q added with Handle is also a method of the receiver",
+					DottedNames(old.name, methodName))
+			case oldMethod.handler != nil:
+				service.methods[methodName] = oldMethod
+			case m != nil:
+				if err := m.inherit(DottedNames(old.name, methodName), oldMethod); err != nil {
+					return err
+				}
+			}
+		}
+		reg.services[name] = service
+		return nil
+	})
+}
+
+// inherit keeps the settings of the old method replaced by m, see
+// ReplaceService.
+func (m *RpcServiceMethod) inherit(name string, old *RpcServiceMethod) error {
+	if old.paramNames != nil {
+		if len(old.paramNames) != len(m.paramTypes) {
+			return fmt.Errorf("rpc: can't keep the param names of method %q, it has %d parameters now",
+				name, len(m.paramTypes))
+		}
+		m.paramNames = old.paramNames
+	}
+	m.aliases = old.aliases
+	m.interceptors = old.interceptors
+	m.doc = old.doc
+	m.paramsSchema, m.schemaPatterns = old.paramsSchema, old.schemaPatterns
+	if m.options == nil {
+		m.options, m.limiter = old.options, old.limiter
+	}
+	if m.timeout == 0 {
+		m.timeout = old.timeout
+	}
+	return nil
+}
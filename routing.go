@@ -0,0 +1,76 @@
+package rpcserver
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// ----------------------------------------------------------------------------
+// Routing
+// ----------------------------------------------------------------------------
+
+// Routing chooses how the URL path of a request selects the method.
+type Routing int
+
+const (
+	// RoutePathSuffix requires the path to end with the method name from the
+	// body, as in "/rpc/Arith.Multiply". It is the default mode.
+	RoutePathSuffix Routing = iota
+
+	// RouteSingleEndpoint takes the method from the body only, all requests
+	// may be sent to the same path, as in "/rpc".
+	RouteSingleEndpoint
+
+	// RoutePrefixNamespace takes the service from the last part of the path
+	// and the method from the body, as in "/rpc/Arith" with "Multiply". They
+	// are joined with the NameMapper.
+	RoutePrefixNamespace
+)
+
+// SetRouting sets the routing mode, see Routing.
+//
+// Methods served by the server itself, CancelMethod and DiscoverMethod, are
+// called by their name in every mode.
+func (s *Server) SetRouting(routing Routing) {
+	s.routing = routing
+}
+
+// checkPath returns an error if the path can't lead to a method, before the
+// body is read.
+func (s *Server) checkPath(path string) error {
+	switch s.routing {
+	case RoutePathSuffix:
+		if isBuiltinPath(path) {
+			return nil
+		}
+		_, _, err := s.get(LastPart(path))
+		return err
+	case RoutePrefixNamespace:
+		if isBuiltinPath(path) {
+			return nil
+		}
+		if service := LastPart(path); !s.hasNamespace(service) {
+			return fmt.Errorf("rpc: can't find service %q", service)
+		}
+	}
+	return nil
+}
+
+// route returns the full name of the method called by the request with the
+// method name from the body.
+func (s *Server) route(r *http.Request, method string) (string, error) {
+	switch s.routing {
+	case RoutePathSuffix:
+		if !PathHasMethod(r.URL.Path, method) {
+			return "", &Error{
+				Code:    CodeMethodNotFound,
+				Message: fmt.Sprintf("rpc: URL.Path '%v' does not end with method Name '%v'", r.URL.Path, method),
+			}
+		}
+	case RoutePrefixNamespace:
+		if method != CancelMethod && method != DiscoverMethod {
+			return s.registry.Load().nameMapper(LastPart(r.URL.Path), method), nil
+		}
+	}
+	return method, nil
+}
@@ -0,0 +1,234 @@
+package rpcserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// Schema
+// ----------------------------------------------------------------------------
+
+var (
+	typeOfTime       = reflect.TypeOf(time.Time{})
+	typeOfRawMessage = reflect.TypeOf(json.RawMessage{})
+)
+
+// Schema is a JSON Schema describing a Go type as encoded by encoding/json.
+type Schema struct {
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	ContentEncoding      string             `json:"contentEncoding,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	MaxLength            *int               `json:"maxLength,omitempty"`
+	MinItems             *int               `json:"minItems,omitempty"`
+	MaxItems             *int               `json:"maxItems,omitempty"`
+	MinProperties        *int               `json:"minProperties,omitempty"`
+	MaxProperties        *int               `json:"maxProperties,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+	Enum                 []interface{}      `json:"enum,omitempty"`
+}
+
+// SchemaOf returns the schema of the Go type.
+//
+// Struct fields follow the json tags. Fields which are pointers or are
+// tagged with omitempty are optional, others are required. Fields with the
+// string option are described as strings. Recursive types are described as
+// any value where they recur. The rules of validate tags are added as the
+// matching keywords, see Server.validate.
+//
+// 64-bit integers have the format "int64" or "uint64", codecs sending them as
+// strings may describe them as strings.
+func SchemaOf(t reflect.Type) *Schema {
+	return schemaOf(t, make(map[reflect.Type]bool))
+}
+
+func schemaOf(t reflect.Type, seen map[reflect.Type]bool) *Schema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t {
+	case typeOfTime:
+		return &Schema{Type: "string", Format: "date-time"}
+	case typeOfRawMessage:
+		return &Schema{}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int64:
+		return &Schema{Type: "integer", Format: "int64"}
+	case reflect.Uint, reflect.Uint64, reflect.Uintptr:
+		return &Schema{Type: "integer", Format: "uint64"}
+	case reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return &Schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8 {
+			return &Schema{Type: "string", ContentEncoding: "base64"}
+		}
+		return &Schema{Type: "array", Items: schemaOf(t.Elem(), seen)}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: schemaOf(t.Elem(), seen)}
+	case reflect.Struct:
+		if seen[t] {
+			return &Schema{}
+		}
+		seen[t] = true
+		defer delete(seen, t)
+		s := &Schema{Type: "object", Properties: make(map[string]*Schema)}
+		addFields(s, t, seen)
+		return s
+	}
+	// Interfaces and the types encoding/json can't encode.
+	return &Schema{}
+}
+
+// addFields adds the fields of the struct, including the ones of embedded
+// structs, to the properties of the schema.
+func addFields(s *Schema, t reflect.Type, seen map[reflect.Type]bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, omitempty, ok := jsonField(field)
+		if !ok {
+			continue
+		}
+		if field.Anonymous && name == "" {
+			embedded := field.Type
+			if embedded.Kind() == reflect.Ptr {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				addFields(s, embedded, seen)
+				continue
+			}
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		s.Properties[name] = schemaOf(field.Type, seen)
+		if tag := field.Tag.Get("validate"); tag != "" {
+			addRules(s.Properties[name], tag)
+		}
+		if hasStringOption(field) {
+			quoteSchema(s.Properties[name], field.Type)
+		}
+		if !omitempty && field.Type.Kind() != reflect.Ptr {
+			s.Required = append(s.Required, name)
+		}
+	}
+}
+
+// hasStringOption returns true if the field has the string option of the
+// json tag.
+func hasStringOption(field reflect.StructField) bool {
+	options := strings.Split(field.Tag.Get("json"), ",")[1:]
+	for _, option := range options {
+		if option == "string" {
+			return true
+		}
+	}
+	return false
+}
+
+// quoteSchema describes a number or a boolean of the Go type as the string
+// holding it, as encoding/json encodes the fields with the string option. The
+// format is the Go type of the value, e.g. "int32".
+func quoteSchema(s *Schema, t reflect.Type) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch s.Type {
+	case "integer", "number", "boolean":
+		if s.Format == "" {
+			s.Format = t.Kind().String()
+		}
+		s.Type = "string"
+		for i, value := range s.Enum {
+			s.Enum[i] = fmt.Sprint(value)
+		}
+	}
+}
+
+// jsonField returns the name from the json tag of the field and if it is
+// omitempty. It returns false for the fields skipped by encoding/json.
+func jsonField(field reflect.StructField) (string, bool, bool) {
+	tag := field.Tag.Get("json")
+	if tag == "-" {
+		return "", false, false
+	}
+	if field.PkgPath != "" && !field.Anonymous {
+		return "", false, false
+	}
+	parts := strings.Split(tag, ",")
+	omitempty := false
+	for _, option := range parts[1:] {
+		if option == "omitempty" {
+			omitempty = true
+		}
+	}
+	return parts[0], omitempty, true
+}
+
+// addRules sets the keywords matching the rules of the validate tag. Malformed
+// tags are skipped, they are reported when the method is registered.
+func addRules(s *Schema, tag string) {
+	rules, err := parseTag(tag)
+	if err != nil {
+		return
+	}
+	for _, r := range rules {
+		switch r.name {
+		case "min", "max":
+			limit := r.limit
+			n := int(limit)
+			switch {
+			case s.Type == "string" && r.name == "min":
+				s.MinLength = &n
+			case s.Type == "string":
+				s.MaxLength = &n
+			case s.Type == "array" && r.name == "min":
+				s.MinItems = &n
+			case s.Type == "array":
+				s.MaxItems = &n
+			case s.Type == "object" && r.name == "min":
+				s.MinProperties = &n
+			case s.Type == "object":
+				s.MaxProperties = &n
+			case r.name == "min":
+				s.Minimum = &limit
+			default:
+				s.Maximum = &limit
+			}
+		case "pattern":
+			s.Pattern = r.arg
+		case "enum":
+			for _, value := range r.enum {
+				if s.Type == "integer" || s.Type == "number" {
+					if n, err := strconv.ParseFloat(value, 64); err == nil {
+						s.Enum = append(s.Enum, n)
+						continue
+					}
+				}
+				s.Enum = append(s.Enum, value)
+			}
+		}
+	}
+}
@@ -7,10 +7,15 @@
 package rpcserver
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
-	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // ----------------------------------------------------------------------------
@@ -24,30 +29,175 @@ import (
 //    - The receiver is exported (begins with an upper case letter) or local
 //      (defined in the package registering the service).
 //    - The method name is exported.
-//    - The method has three arguments: *http.Request, *args, *reply.
-//    - All three arguments are pointers.
+//    - The method has three arguments: *http.Request or context.Context,
+//      *args, *reply.
+//    - The args and reply arguments are pointers.
 //    - The second and third arguments are exported or local.
 //    - The method has return type error.
 //
-
+// Alternatively the method may return the reply:
+//
+//    - The method has two arguments: *http.Request or context.Context, args.
+//    - The args argument is a value or a pointer, exported or local.
+//    - The method has return types (reply, error), reply is exported or local.
+//
+// A method returning the reply may take any number of parameters after
+// *http.Request or context.Context. They are read by position, or by name
+// once the names are set with SetParamNames.
+//
+// The receiver becomes the default service: its methods are called by their
+// bare names, e.g. "Multiply". More receivers can be added with
+// RegisterService. A nil receiver creates a server without a default service.
+//
+// Methods taking context.Context get a context derived from the request
+// context, see RequestFromContext, IdFromContext and MethodFromContext. The
+// same context is set to the *http.Request given to other methods.
 func NewServer(receiver interface{}) (*Server, error) {
-	service, err := NewRpcService(receiver)
-	if err != nil {
-		return nil, err
-	}
-
 	server := &Server{
-		codecs:  make(map[string]Codec),
-		service: service,
+		batchWorkers: 1,
+		panicHandler: logPanic,
+		statusPolicy: StatusAlways200,
+		info: OpenRPCInfo{
+			Title:   "rpcserver",
+			Version: "0.0.0",
+		},
+	}
+	server.registry.Store(&registry{
+		codecs:     make(map[string]Codec),
+		services:   make(map[string]*RpcService),
+		nameMapper: DottedNames,
+	})
+	if receiver != nil {
+		service, err := NewRpcService(receiver)
+		if err != nil {
+			return nil, err
+		}
+		err = server.addReceiver(context.Background(), receiver, func(reg *registry) error {
+			reg.services[""] = service
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
 	}
 	// TODO: maybe register default json-rpc codec
 	return server, nil
 }
 
-// Server serves registered RPC service using registered codecs.
+// Server serves registered RPC services using registered codecs.
+//
+// Codecs and services may be registered, unregistered and replaced while the
+// server is serving, and the settings of methods, e.g. SetMethodTimeout, may be
+// changed. Other settings must be made before.
 type Server struct {
-	codecs  map[string]Codec
-	service *RpcService
+	mu           sync.Mutex               // serializes changes of the registry
+	registry     atomic.Pointer[registry] // codecs and services
+	batchWorkers int                      // max concurrent requests of one batch
+	asyncNotify  bool                     // call notifications after the response
+	interceptors []Interceptor            // run around every call
+	panicHandler PanicHandler             // reports recovered panics
+	statusPolicy StatusPolicy             // HTTP status of errors
+
+	errorMappings []errorMapping // codes of errors returned by calls
+	errorMode     ErrorMode      // how errors without a code are sent
+
+	timeout    time.Duration // timeout of calls, 0 means no timeout
+	maxTimeout time.Duration // limit of timeouts requested by clients
+
+	inflight inflight    // running calls which can be cancelled
+	info     OpenRPCInfo // published by DiscoverMethod
+	routing  Routing     // how the path selects the method
+
+	permissionChecker PermissionChecker // checks permissions of MethodOptions
+
+	lifecycle lifecycle // running calls, see Shutdown
+}
+
+// RegisterService adds a new service to the server.
+//
+// The name is used as a prefix for the methods of the receiver, as in
+// "Service.Method". If name is empty the receiver type name is used instead.
+// The receiver methods must follow the rules described for NewServer, other
+// exported methods are reported by SkippedMethods. A receiver implementing
+// Describer sets the options of its methods, one implementing Initializer is
+// initialized before it is added and stopped if it can't be added. Malformed
+// validate tags of the args are reported as errors.
+func (s *Server) RegisterService(receiver interface{}, name string) error {
+	return s.RegisterServiceContext(context.Background(), receiver, name)
+}
+
+// RegisterServiceContext is RegisterService with the context given to the
+// Init hook of the receiver, see Initializer.
+func (s *Server) RegisterServiceContext(ctx context.Context, receiver interface{}, name string) error {
+	service, err := NewRpcService(receiver)
+	if err != nil {
+		return err
+	}
+	if name != "" {
+		service.name = name
+	}
+	return s.addReceiver(ctx, receiver, func(reg *registry) error {
+		if _, ok := reg.services[service.name]; ok {
+			return fmt.Errorf("rpc: service already defined: %q", service.name)
+		}
+		reg.services[service.name] = service
+		return nil
+	})
+}
+
+// SetBatchWorkers sets how many requests of one batch may run concurrently.
+//
+// The default is 1: requests of a batch are served one after another in the
+// batch order. Values below 1 are treated as 1.
+func (s *Server) SetBatchWorkers(workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+	s.batchWorkers = workers
+}
+
+// SetSequential marks the service as not safe for concurrent use.
+//
+// Requests of a batch to a sequential service are served one after another
+// in the batch order, even if SetBatchWorkers allows more workers. The name
+// is the one used in RegisterService, "" is the default service.
+func (s *Server) SetSequential(name string, sequential bool) error {
+	return s.update(func(reg *registry) error {
+		service := reg.services[name]
+		if service == nil {
+			return fmt.Errorf("rpc: can't find service %q", name)
+		}
+		service = service.clone()
+		service.sequential = sequential
+		reg.services[name] = service
+		return nil
+	})
+}
+
+// SetParamNames sets the names of the parameters of a method with several
+// parameters, which allows to call it with parameters by name. See NameMapper
+// for the name of the method.
+func (s *Server) SetParamNames(method string, names ...string) error {
+	return s.updateMethod(method, func(methodSpec *RpcServiceMethod) error {
+		if methodSpec.paramTypes == nil {
+			return fmt.Errorf("rpc: method %q has no separate parameters", method)
+		}
+		if len(names) != len(methodSpec.paramTypes) {
+			return fmt.Errorf("rpc: method %q has %d parameters, got %d names",
+				method, len(methodSpec.paramTypes), len(names))
+		}
+		methodSpec.paramNames = names
+		return nil
+	})
+}
+
+// SetAsyncNotifications makes notifications to be called after the response.
+//
+// It has effect only for the requests which the codec treats as notifications,
+// see CodecRequest.IsNotification. Their context is not cancelled when the
+// HTTP request is done. Errors of notifications are logged either way.
+func (s *Server) SetAsyncNotifications(async bool) {
+	s.asyncNotify = async
 }
 
 // RegisterCodec adds a new codec to the server.
@@ -56,19 +206,45 @@ type Server struct {
 // XML. A codec is chosen based on the "Content-Type" header from the request,
 // excluding the charset definition.
 func (s *Server) RegisterCodec(codec Codec, contentType string) {
-	s.codecs[strings.ToLower(contentType)] = codec
+	s.update(func(reg *registry) error {
+		reg.codecs[strings.ToLower(contentType)] = codec
+		return nil
+	})
 }
 
-// HasMethod returns true if the given method is registered.
-//
-// The method uses a dotted notation as in "Service.Method".
+// HasMethod returns true if the given method is registered, by a name as
+// described by NameMapper.
 func (s *Server) HasMethod(method string) bool {
-	if _, err := s.service.Get(method); err == nil {
+	if _, _, err := s.get(method); err == nil {
 		return true
 	}
 	return false
 }
 
+// get returns the service and the method registered under the given name,
+// see SetNameMapper.
+//
+// The error has CodeMethodNotFound if there is no such method.
+func (s *Server) get(method string) (*RpcService, *RpcServiceMethod, error) {
+	ref, err := s.lookup(method)
+	return ref.service, ref.method, err
+}
+
+// lookup returns the method registered under the given name.
+func (s *Server) lookup(method string) (methodRef, error) {
+	return s.registry.Load().lookup(method)
+}
+
+// splitMethod splits "Service.Method" into the service and the method names.
+//
+// The service name is empty for names without a dot.
+func splitMethod(method string) (string, string) {
+	if idx := strings.LastIndex(method, "."); idx != -1 {
+		return method[:idx], method[idx+1:]
+	}
+	return "", method
+}
+
 // ServeHTTP
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
@@ -81,71 +257,207 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		contentType = contentType[:idx]
 	}
 	var codec Codec
-	if contentType == "" && len(s.codecs) == 1 {
+	codecs := s.registry.Load().codecs
+	if contentType == "" && len(codecs) == 1 {
 		// If Content-Type is not set and only one codec has been registered,
 		// then default to that codec.
-		for _, c := range s.codecs {
+		for _, c := range codecs {
 			codec = c
 		}
-	} else if codec = s.codecs[strings.ToLower(contentType)]; codec == nil {
+	} else if codec = codecs[strings.ToLower(contentType)]; codec == nil {
 		WriteError(w, 415, "rpc: unrecognized Content-Type: "+contentType)
 		return
 	}
 
-	pathMethod := LastPart(r.URL.Path)
-	_, errGet := s.service.Get(pathMethod)
-	if errGet != nil {
-		WriteError(w, 404, errGet.Error())
+	if errPath := s.checkPath(r.URL.Path); errPath != nil {
+		WriteError(w, 404, errPath.Error())
 		return
 	}
 
 	// Create a new codec request.
 	codecReq := codec.NewRequest(r)
 
+	if !s.lifecycle.begin() {
+		s.serveShutdown(w, codecReq)
+		return
+	}
+	defer s.lifecycle.calls.Done()
+
+	if batch, ok := codecReq.(BatchCodecRequest); ok && batch.IsBatch() {
+		s.serveBatch(w, r, batch.Requests())
+		batch.WriteBatch(w)
+		return
+	}
+	s.serveRequest(w, r, codecReq)
+}
+
+// isBuiltinPath returns true if the path ends with a method served by the
+// server itself.
+func isBuiltinPath(path string) bool {
+	return PathHasMethod(path, CancelMethod) || PathHasMethod(path, DiscoverMethod)
+}
+
+// serveBatch calls the service methods for the requests of a batch.
+//
+// Up to s.batchWorkers requests are served concurrently. Requests to a
+// sequential service are served in order by a single worker.
+func (s *Server) serveBatch(w http.ResponseWriter, r *http.Request, requests []CodecRequest) {
+	if s.batchWorkers == 1 {
+		for _, req := range requests {
+			s.serveRequest(w, r, req)
+		}
+		return
+	}
+
+	var groups [][]CodecRequest
+	sequential := make(map[*RpcService]int) // index in groups
+	for _, req := range requests {
+		service := s.sequentialService(r, req)
+		if service == nil {
+			groups = append(groups, []CodecRequest{req})
+		} else if idx, ok := sequential[service]; ok {
+			groups[idx] = append(groups[idx], req)
+		} else {
+			sequential[service] = len(groups)
+			groups = append(groups, []CodecRequest{req})
+		}
+	}
+
+	var wg sync.WaitGroup
+	workers := make(chan struct{}, s.batchWorkers)
+	for _, group := range groups {
+		wg.Add(1)
+		workers <- struct{}{}
+		go func(group []CodecRequest) {
+			defer func() {
+				<-workers
+				wg.Done()
+			}()
+			for _, req := range group {
+				s.serveRequest(w, r, req)
+			}
+		}(group)
+	}
+	wg.Wait()
+}
+
+// sequentialService returns the service of the request if it is sequential.
+func (s *Server) sequentialService(r *http.Request, codecReq CodecRequest) *RpcService {
+	methodName, err := codecReq.Method()
+	if err == nil {
+		methodName, err = s.route(r, methodName)
+	}
+	if err != nil {
+		return nil
+	}
+	service, _, err := s.get(methodName)
+	if err != nil || !service.sequential {
+		return nil
+	}
+	return service
+}
+
+// serveRequest calls the service method for a single codec request and
+// writes its response.
+func (s *Server) serveRequest(w http.ResponseWriter, r *http.Request, codecReq CodecRequest) {
 	if codecReq.Error() != nil {
-		codecReq.WriteError(w, 400, codecReq.Error())
+		s.writeError(w, codecReq, codecReq.Error())
 		return
 	}
 
 	// Get service method to be called.
 	methodName, errMethod := codecReq.Method()
+	if errMethod == nil {
+		methodName, errMethod = s.route(r, methodName)
+	}
 	if errMethod != nil {
-		codecReq.WriteError(w, 400, errMethod)
+		s.writeError(w, codecReq, errMethod)
+		return
+	}
+
+	switch methodName {
+	case CancelMethod:
+		s.serveCancel(w, r, codecReq)
+		return
+	case DiscoverMethod:
+		s.serveDiscover(w, codecReq)
 		return
 	}
 
-	methodSpec, errGet := s.service.Get(methodName)
+	ref, errGet := s.lookup(methodName)
 	if errGet != nil {
-		codecReq.WriteError(w, 400, errGet)
+		s.writeError(w, codecReq, errGet)
+		return
+	}
+	service, methodSpec := ref.service, ref.method
+	methodName = ref.name // not an alias
+	// Make the context of the call.
+	ctx := newContext(r.Context(), r, codecReq.Id(), methodName)
+	r = r.WithContext(ctx)
+	if errOptions := s.checkOptions(ctx, methodSpec); errOptions != nil {
+		s.writeError(w, codecReq, errOptions)
 		return
 	}
 	// Decode the args.
-	args := reflect.New(methodSpec.argsType)
-	if errRead := codecReq.ReadRequest(args.Interface()); errRead != nil {
-		codecReq.WriteError(w, 400, errRead)
+	args := methodSpec.Args()
+	if errRead := codecReq.ReadRequest(args); errRead != nil {
+		s.writeError(w, codecReq, errRead)
 		return
 	}
-	// Call the service method.
-	reply := reflect.New(methodSpec.replyType)
-	errValue := methodSpec.method.Func.Call([]reflect.Value{
-		s.service.rcvr,
-		reflect.ValueOf(r),
-		args,
-		reply,
-	})
-	// Cast the result to error if needed.
-	var errResult error
-	errInter := errValue[0].Interface()
-	if errInter != nil {
-		errResult = errInter.(error)
+	if errValidate := s.validate(methodSpec, args); errValidate != nil {
+		s.writeError(w, codecReq, errValidate)
+		return
+	}
+	call := &Call{
+		Method:  methodName,
+		Args:    args,
+		Request: r,
+	}
+	timeout := s.timeoutFor(r, methodSpec)
+	if s.asyncNotify && codecReq.IsNotification() {
+		codecReq.WriteResponse(w, nil)
+		ctx = context.WithoutCancel(ctx)
+		s.lifecycle.calls.Add(1)
+		go func() {
+			defer s.lifecycle.calls.Done()
+			if _, errResult := s.invokeTimeout(ctx, timeout, call, service, methodSpec); errResult != nil {
+				logNotificationError(methodName, errResult)
+			}
+		}()
+		return
+	}
+	// Call the service method, the client may cancel it by id.
+	if id, session := codecReq.Id(), r.Header.Get(SessionHeader); id != "" && session != "" {
+		var done func()
+		ctx, done = s.inflight.add(ctx, inflightKey{session: session, id: id})
+		defer done()
+	}
+	reply, errResult := s.invokeTimeout(ctx, timeout, call, service, methodSpec)
+	if errResult != nil && errors.Is(errResult, context.Canceled) && ctx.Err() == context.Canceled {
+		errResult = errCancelled
 	}
 
 	// Encode the response.
 	if errResult == nil {
-		codecReq.WriteResponse(w, reply.Interface())
+		codecReq.WriteResponse(w, reply)
 	} else {
-		codecReq.WriteError(w, 400, errResult)
+		s.writeError(w, codecReq, s.sanitizeError(methodName, errResult))
+	}
+}
+
+// writeError writes the error of the call with the HTTP status chosen by the
+// status policy. Errors of notifications are logged as the client never
+// sees them.
+func (s *Server) writeError(w http.ResponseWriter, codecReq CodecRequest, err error) {
+	if codecReq.IsNotification() {
+		methodName, _ := codecReq.Method()
+		logNotificationError(methodName, err)
 	}
+	codecReq.WriteError(w, s.statusPolicy(ErrorCode(err)), err)
+}
+
+func logNotificationError(method string, err error) {
+	log.Printf("rpc: notification %q failed: %v", method, err)
 }
 
 func WriteError(w http.ResponseWriter, status int, msg string) {
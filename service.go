@@ -7,17 +7,22 @@
 package rpcserver
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"reflect"
+	"regexp"
+	"time"
 	"unicode"
 	"unicode/utf8"
 )
 
 var (
-	// Precompute the reflect.Type of error and http.Request
+	// Precompute the reflect.Type of error, http.Request and context.Context
 	TypeOfError   = reflect.TypeOf((*error)(nil)).Elem()
 	TypeOfRequest = reflect.TypeOf((*http.Request)(nil)).Elem()
+	TypeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
+	TypeOfParams  = reflect.TypeOf(Params{})
 )
 
 // ----------------------------------------------------------------------------
@@ -25,16 +30,36 @@ var (
 // ----------------------------------------------------------------------------
 
 type RpcService struct {
-	name     string                       // name of service
-	rcvr     reflect.Value                // receiver of methods for the service
-	rcvrType reflect.Type                 // type of the receiver
-	methods  map[string]*RpcServiceMethod // registered methods
+	name       string                       // name of service
+	rcvr       reflect.Value                // receiver of methods for the service
+	rcvrType   reflect.Type                 // type of the receiver
+	methods    map[string]*RpcServiceMethod // registered methods
+	sequential bool                         // not safe for concurrent use
+	skipped    map[string]string            // reasons of skipped exported methods
 }
 
 type RpcServiceMethod struct {
-	method    reflect.Method // receiver method
-	argsType  reflect.Type   // type of the request argument
-	replyType reflect.Type   // type of the response argument
+	aliases        []string                  // other names, see SetAliases
+	method         reflect.Method            // receiver method, unset for handlers
+	argsType       reflect.Type              // type of the request argument
+	replyType      reflect.Type              // type of the response argument
+	withContext    bool                      // first argument is context.Context
+	argsByValue    bool                      // args are not passed as a pointer
+	returnsReply   bool                      // reply is returned instead of being filled
+	paramTypes     []reflect.Type            // set for methods with several parameters
+	paramNames     []string                  // names of the parameters, see Params
+	interceptors   []Interceptor             // run around the calls of this method only
+	timeout        time.Duration             // timeout of calls, 0 means the server one
+	doc            *MethodDoc                // published by DiscoverMethod
+	options        *MethodOptions            // set with Describer or SetMethodOptions
+	limiter        *rateLimiter              // nil if calls are not limited
+	paramsSchema   *Schema                   // validated before calls, see SetParamsSchema
+	rules          map[string][]*rule        // parsed validate tags of the args
+	schemaPatterns map[string]*regexp.Regexp // compiled patterns of paramsSchema
+
+	// Set for methods registered with Handle instead of a receiver.
+	handler func(ctx context.Context, args interface{}) (interface{}, error)
+	newArgs func() interface{}
 }
 
 // NewRpcService creates a RpcService object with assotiated RpcServiceMethods.
@@ -44,6 +69,7 @@ func NewRpcService(rcvr interface{}) (*RpcService, error) {
 		rcvr:     reflect.ValueOf(rcvr),
 		rcvrType: reflect.TypeOf(rcvr),
 		methods:  make(map[string]*RpcServiceMethod),
+		skipped:  make(map[string]string),
 	}
 	s.name = reflect.Indirect(s.rcvr).Type().Name()
 	if !IsExported(s.name) {
@@ -52,48 +78,198 @@ func NewRpcService(rcvr interface{}) (*RpcService, error) {
 	// Setup methods.
 	for i := 0; i < s.rcvrType.NumMethod(); i++ {
 		method := s.rcvrType.Method(i)
-		mtype := method.Type
-		// Method must be exported.
-		if method.PkgPath != "" {
+		if isHookMethod(s.rcvrType, method.Name) {
 			continue
 		}
-		// Method needs four ins: receiver, *http.Request, *args, *reply.
-		if mtype.NumIn() != 4 {
-			continue
+		m, reason := newRpcServiceMethod(method)
+		if m != nil {
+			s.methods[m.method.Name] = m
+		} else if method.PkgPath == "" {
+			s.skipped[method.Name] = reason
 		}
-		// First argument must be a pointer and must be http.Request.
-		reqType := mtype.In(1)
-		if reqType.Kind() != reflect.Ptr || reqType.Elem() != TypeOfRequest {
-			continue
+	}
+	if len(s.methods) == 0 {
+		return nil, fmt.Errorf("rpc: %q has no exported methods of suitable type",
+			s.name)
+	}
+	for name, m := range s.methods {
+		if err := m.parseRules(); err != nil {
+			return nil, fmt.Errorf("rpc: method %q of %q: %v", name, s.name, err)
 		}
-		// Second argument must be a pointer and must be exported.
-		args := mtype.In(2)
-		if args.Kind() != reflect.Ptr || !IsExportedOrBuiltin(args) {
-			continue
+	}
+	if describer, ok := rcvr.(Describer); ok {
+		for name, options := range describer.DescribeMethods() {
+			m := s.methods[name]
+			if m == nil {
+				return nil, fmt.Errorf("rpc: %q has options for unknown method %q",
+					s.name, name)
+			}
+			m.setOptions(options)
 		}
-		// Third argument must be a pointer and must be exported.
-		reply := mtype.In(3)
-		if reply.Kind() != reflect.Ptr || !IsExportedOrBuiltin(reply) {
-			continue
+	}
+	return s, nil
+}
+
+// newRpcServiceMethod returns nil and the reason if the method is not of
+// suitable type.
+//
+// These forms are suitable, where req is *http.Request or context.Context:
+//
+//	func (t *T) Method(req, args *Args, reply *Reply) error
+//	func (t *T) Method(req, args Args) (Reply, error)
+//	func (t *T) Method(req, a A, b B, ...) (Reply, error)
+//
+// In the second form args may be passed by value or by pointer. In the third
+// form any number of parameters except one is accepted, see Params. Variadic
+// methods are not suitable.
+func newRpcServiceMethod(method reflect.Method) (*RpcServiceMethod, string) {
+	mtype := method.Type
+	// Method must be exported.
+	if method.PkgPath != "" {
+		return nil, "not exported"
+	}
+	// Method must not be variadic, args are not passed as a slice.
+	if mtype.IsVariadic() {
+		return nil, "variadic"
+	}
+	// Method needs at least two ins: receiver, *http.Request or context.Context.
+	if mtype.NumIn() < 2 {
+		return nil, "no arguments"
+	}
+	// First argument must be context.Context or a pointer to http.Request.
+	reqType := mtype.In(1)
+	withContext := reqType == TypeOfContext
+	if !withContext && (reqType.Kind() != reflect.Ptr || reqType.Elem() != TypeOfRequest) {
+		return nil, "first argument is not *http.Request or context.Context"
+	}
+	// Other arguments must be exported.
+	for i := 2; i < mtype.NumIn(); i++ {
+		if !IsExportedOrBuiltin(mtype.In(i)) {
+			return nil, fmt.Sprintf("argument type %s is not exported", mtype.In(i))
+		}
+	}
+	m := &RpcServiceMethod{
+		method:      method,
+		withContext: withContext,
+	}
+	if mtype.NumOut() == 1 {
+		// Method needs four ins: receiver, req, *args, *reply.
+		if mtype.NumIn() != 4 {
+			return nil, "returns only error but has no args and reply arguments"
+		}
+		// Second and third arguments must be pointers.
+		args, reply := mtype.In(2), mtype.In(3)
+		if args.Kind() != reflect.Ptr || reply.Kind() != reflect.Ptr {
+			return nil, "args and reply arguments are not pointers"
 		}
 		// Method needs one out: error.
-		if mtype.NumOut() != 1 {
-			continue
+		if mtype.Out(0) != TypeOfError {
+			return nil, "does not return error"
 		}
-		if returnType := mtype.Out(0); returnType != TypeOfError {
-			continue
+		m.argsType = args.Elem()
+		m.replyType = reply.Elem()
+		return m, ""
+	}
+	// Method needs two outs: reply and error.
+	if mtype.NumOut() != 2 || mtype.Out(1) != TypeOfError {
+		return nil, "does not return error or (reply, error)"
+	}
+	// Reply must be exported.
+	reply := mtype.Out(0)
+	if !IsExportedOrBuiltin(reply) {
+		return nil, fmt.Sprintf("reply type %s is not exported", reply)
+	}
+	m.replyType = reply
+	m.returnsReply = true
+	if mtype.NumIn() != 3 {
+		m.argsType = TypeOfParams
+		m.paramTypes = make([]reflect.Type, mtype.NumIn()-2)
+		for i := range m.paramTypes {
+			m.paramTypes[i] = mtype.In(i + 2)
+		}
+		return m, ""
+	}
+	if args := mtype.In(2); args.Kind() == reflect.Ptr {
+		m.argsType = args.Elem()
+	} else {
+		m.argsType = args
+		m.argsByValue = true
+	}
+	return m, ""
+}
+
+// Args returns a pointer to a new value of the args type.
+//
+// For methods with several parameters it is a *Params.
+func (m *RpcServiceMethod) Args() interface{} {
+	if m.newArgs != nil {
+		return m.newArgs()
+	}
+	if m.paramTypes != nil {
+		params := &Params{
+			Names:  m.paramNames,
+			Values: make([]interface{}, len(m.paramTypes)),
 		}
-		s.methods[method.Name] = &RpcServiceMethod{
-			method:    method,
-			argsType:  args.Elem(),
-			replyType: reply.Elem(),
+		for i, t := range m.paramTypes {
+			params.Values[i] = reflect.New(t).Interface()
 		}
+		return params
 	}
-	if len(s.methods) == 0 {
-		return nil, fmt.Errorf("rpc: %q has no exported methods of suitable type",
-			s.name)
+	return reflect.New(m.argsType).Interface()
+}
+
+// call invokes the method with args made by Args.
+//
+// It returns the reply to be encoded and the error returned by the method.
+func (m *RpcServiceMethod) call(rcvr reflect.Value, r *http.Request, ctx context.Context, args interface{}) (interface{}, error) {
+	if m.handler != nil {
+		return m.handler(ctx, args)
 	}
-	return s, nil
+	reqValue := reflect.ValueOf(r)
+	if m.withContext {
+		reqValue = reflect.ValueOf(ctx)
+	}
+	if m.paramTypes != nil {
+		in := []reflect.Value{rcvr, reqValue}
+		for _, v := range args.(*Params).Values {
+			in = append(in, reflect.ValueOf(v).Elem())
+		}
+		out := m.method.Func.Call(in)
+		return out[0].Interface(), asError(out[1])
+	}
+	argsValue := reflect.ValueOf(args)
+	if m.argsByValue {
+		argsValue = argsValue.Elem()
+	}
+	if m.returnsReply {
+		out := m.method.Func.Call([]reflect.Value{rcvr, reqValue, argsValue})
+		return out[0].Interface(), asError(out[1])
+	}
+	reply := reflect.New(m.replyType)
+	out := m.method.Func.Call([]reflect.Value{rcvr, reqValue, argsValue, reply})
+	return reply.Interface(), asError(out[0])
+}
+
+// asError casts the returned value to error if needed.
+func asError(v reflect.Value) error {
+	if err := v.Interface(); err != nil {
+		return err.(error)
+	}
+	return nil
+}
+
+// ----------------------------------------------------------------------------
+// Params
+// ----------------------------------------------------------------------------
+
+// Params holds the arguments of a method with several parameters.
+//
+// Each value is a pointer to a zero value of the parameter type. Codecs fill
+// values by position, or by name if the names were set with SetParamNames.
+// Missing trailing values are left as zero values.
+type Params struct {
+	Names  []string      // nil if the names are unknown
+	Values []interface{} // pointers to the parameters
 }
 
 // get returns a registered object given a method name.
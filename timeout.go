@@ -0,0 +1,109 @@
+package rpcserver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// Timeout
+// ----------------------------------------------------------------------------
+
+// TimeoutHeader is the HTTP header with the timeout requested by the client,
+// in the format of time.ParseDuration, e.g. "1.5s".
+const TimeoutHeader = "X-Rpc-Timeout"
+
+// SetTimeout sets the timeout of every call, 0 means no timeout.
+//
+// The context of the call is cancelled when the timeout passes and the client
+// gets an error with CodeTimeout, even if the method is still running.
+func (s *Server) SetTimeout(timeout time.Duration) {
+	s.timeout = timeout
+}
+
+// SetMethodTimeout sets the timeout of calls to the method instead of the one
+// set with SetTimeout, 0 means the one of the server. Methods are named as
+// described by NameMapper.
+func (s *Server) SetMethodTimeout(method string, timeout time.Duration) error {
+	return s.updateMethod(method, func(methodSpec *RpcServiceMethod) error {
+		methodSpec.timeout = timeout
+		return nil
+	})
+}
+
+// SetMaxTimeout sets the limit of timeouts requested by clients with
+// TimeoutHeader, 0 means no limit.
+func (s *Server) SetMaxTimeout(timeout time.Duration) {
+	s.maxTimeout = timeout
+}
+
+// timeoutFor returns the timeout of the call to the method, 0 if none.
+//
+// It is the shortest of the server or method timeout and the one requested
+// by the client.
+func (s *Server) timeoutFor(r *http.Request, methodSpec *RpcServiceMethod) time.Duration {
+	timeout := methodSpec.timeout
+	if timeout == 0 {
+		timeout = s.timeout
+	}
+	header := r.Header.Get(TimeoutHeader)
+	if header == "" {
+		return timeout
+	}
+	clientTimeout, err := time.ParseDuration(header)
+	if err != nil || clientTimeout <= 0 {
+		return timeout
+	}
+	if s.maxTimeout > 0 && clientTimeout > s.maxTimeout {
+		clientTimeout = s.maxTimeout
+	}
+	if timeout == 0 || clientTimeout < timeout {
+		return clientTimeout
+	}
+	return timeout
+}
+
+// invokeTimeout calls invoke with the timeout, 0 means no timeout.
+//
+// The call runs in its own goroutine, so the timeout error is returned on
+// time even if the method doesn't watch the context.
+func (s *Server) invokeTimeout(ctx context.Context, timeout time.Duration, call *Call, service *RpcService, methodSpec *RpcServiceMethod) (interface{}, error) {
+	if timeout <= 0 {
+		return s.invoke(ctx, call, service, methodSpec)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	type result struct {
+		reply interface{}
+		err   error
+	}
+	done := make(chan result, 1)
+	s.lifecycle.calls.Add(1) // may run after the request, see Shutdown
+	go func() {
+		defer s.lifecycle.calls.Done()
+		reply, err := s.invoke(ctx, call, service, methodSpec)
+		done <- result{reply, err}
+	}()
+	select {
+	case res := <-done:
+		if res.err != nil && errors.Is(res.err, context.DeadlineExceeded) && ctx.Err() != nil {
+			return nil, newTimeoutError(timeout)
+		}
+		return res.reply, res.err
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, newTimeoutError(timeout)
+		}
+		return nil, ctx.Err()
+	}
+}
+
+func newTimeoutError(timeout time.Duration) error {
+	return &Error{
+		Code:    CodeTimeout,
+		Message: "rpc: call timed out after " + timeout.String(),
+	}
+}
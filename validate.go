@@ -0,0 +1,501 @@
+package rpcserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ----------------------------------------------------------------------------
+// Validation
+// ----------------------------------------------------------------------------
+
+// Violation is a failed constraint of a param, sent in the data of the
+// CodeInvalidParams error.
+type Violation struct {
+	Field   string `json:"field"`   // path of the field as in "items[0].name"
+	Message string `json:"message"` // what is wrong with it
+}
+
+// SetParamsSchema sets the schema the params of the method are validated
+// against before the call, in addition to the rules from the validate tags.
+//
+// The schema applies to the args as encoded to JSON, so "required" means
+// present and not null. The parameters of a method with several parameters
+// are validated as an object once their names are set with SetParamNames, as
+// an array before. It returns an error if a pattern of the schema is not
+// a valid regular expression.
+//
+// The method is named as described by NameMapper.
+func (s *Server) SetParamsSchema(method string, schema *Schema) error {
+	patterns := make(map[string]*regexp.Regexp)
+	if schema != nil {
+		if err := schema.compilePatterns(patterns); err != nil {
+			return err
+		}
+	}
+	return s.updateMethod(method, func(methodSpec *RpcServiceMethod) error {
+		methodSpec.paramsSchema = schema
+		methodSpec.schemaPatterns = patterns
+		return nil
+	})
+}
+
+// validate checks the args decoded for the method.
+//
+// Struct fields are checked with the rules in their validate tag, separated
+// by commas:
+//
+//	required       the value is not zero
+//	omitempty      other rules are skipped for a zero value
+//	min=N, max=N   limits of a number, or of the length of a string, slice or map
+//	pattern=RE     a string matches the regular expression
+//	enum=a|b|c     the value is one of the listed
+//
+// For example `validate:"required,max=64,pattern=^[a-z]+$"`. The pattern
+// takes the rest of the tag, so it must be the last rule and may contain
+// commas. The tags are parsed when the method is registered, see parseRules.
+func (s *Server) validate(methodSpec *RpcServiceMethod, args interface{}) error {
+	if len(methodSpec.rules) == 0 && methodSpec.paramsSchema == nil {
+		return nil // nothing to check, don't walk the args
+	}
+	var violations []*Violation
+	if params, ok := args.(*Params); ok {
+		for i, value := range params.Values {
+			name := strconv.Itoa(i)
+			if params.Names != nil {
+				name = params.Names[i]
+			}
+			violations = validateValue(violations, methodSpec.rules, name, reflect.ValueOf(value))
+		}
+	} else {
+		violations = validateValue(violations, methodSpec.rules, "", reflect.ValueOf(args))
+	}
+	if methodSpec.paramsSchema != nil {
+		data, err := json.Marshal(paramsValue(args))
+		if err != nil {
+			return err
+		}
+		var value interface{}
+		if err := json.Unmarshal(data, &value); err != nil {
+			return err
+		}
+		violations = methodSpec.paramsSchema.validate(violations, methodSpec.schemaPatterns, "", value)
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+	return &Error{
+		Code:    CodeInvalidParams,
+		Message: "invalid params",
+		Data:    violations,
+	}
+}
+
+// paramsValue returns the args as sent by the client: the parameters of a
+// method with several parameters are an object if their names are known, an
+// array otherwise.
+func paramsValue(args interface{}) interface{} {
+	params, ok := args.(*Params)
+	if !ok {
+		return args
+	}
+	if params.Names == nil {
+		return params.Values
+	}
+	object := make(map[string]interface{}, len(params.Values))
+	for i, value := range params.Values {
+		object[params.Names[i]] = value
+	}
+	return object
+}
+
+// validateValue walks the value checking the rules of struct fields, parsed
+// from their validate tags.
+func validateValue(violations []*Violation, rules map[string][]*rule, path string, v reflect.Value) []*Violation {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return violations
+		}
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		t := v.Type()
+		if t == typeOfTime {
+			return violations
+		}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name, _, ok := jsonField(field)
+			if !ok || field.PkgPath != "" {
+				continue
+			}
+			fieldPath := path
+			if !field.Anonymous || name != "" {
+				if name == "" {
+					name = field.Name
+				}
+				fieldPath = joinPath(path, name)
+			}
+			fieldValue := v.Field(i)
+			if tag := field.Tag.Get("validate"); tag != "" {
+				fieldRules, ok := rules[tag]
+				if !ok {
+					// A type behind an interface, not known at registration.
+					fieldRules, _ = parseTag(tag)
+				}
+				violations = checkRules(violations, fieldPath, fieldRules, fieldValue)
+			}
+			violations = validateValue(violations, rules, fieldPath, fieldValue)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			violations = validateValue(violations, rules, fmt.Sprintf("%s[%d]", path, i), v.Index(i))
+		}
+	case reflect.Map:
+		iter := v.MapRange()
+		for iter.Next() {
+			violations = validateValue(violations, rules, joinPath(path, fmt.Sprint(iter.Key().Interface())), iter.Value())
+		}
+	}
+	return violations
+}
+
+// checkRules checks the rules from the validate tag of the field.
+//
+// A nil pointer or interface is a missing value, only required applies to it.
+func checkRules(violations []*Violation, path string, rules []*rule, v reflect.Value) []*Violation {
+	if v.IsZero() {
+		if hasRule(rules, "required") {
+			return append(violations, &Violation{Field: path, Message: "required"})
+		}
+		if hasRule(rules, "omitempty") {
+			return violations
+		}
+	}
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return violations
+		}
+		v = v.Elem()
+	}
+	for _, r := range rules {
+		var msg string
+		switch r.name {
+		case "min", "max":
+			value, isLength := measure(v)
+			if r.name == "min" && value < r.limit || r.name == "max" && value > r.limit {
+				msg = fmt.Sprintf("must be %s %s", limitWord(r.name), r.arg)
+				if isLength {
+					msg = "length " + msg
+				}
+			}
+		case "pattern":
+			if v.Kind() == reflect.String && !r.re.MatchString(v.String()) {
+				msg = "must match " + r.arg
+			}
+		case "enum":
+			if !contains(r.enum, fmt.Sprint(v.Interface())) {
+				msg = "must be one of " + strings.Join(r.enum, ", ")
+			}
+		}
+		if msg != "" {
+			violations = append(violations, &Violation{Field: path, Message: msg})
+		}
+	}
+	return violations
+}
+
+// ----------------------------------------------------------------------------
+// Rules
+// ----------------------------------------------------------------------------
+
+// rule is a parsed rule of a validate tag.
+type rule struct {
+	name  string         // as in the tag, e.g. "min"
+	arg   string         // after "=" in the tag
+	limit float64        // of min and max
+	re    *regexp.Regexp // of pattern
+	enum  []string       // of enum
+}
+
+// parseTag parses the rules of a validate tag, see Server.validate.
+func parseTag(tag string) ([]*rule, error) {
+	var rules []*rule
+	for tag != "" {
+		var text string
+		if strings.HasPrefix(tag, "pattern=") {
+			text, tag = tag, ""
+		} else {
+			text, tag, _ = strings.Cut(tag, ",")
+		}
+		name, arg, hasArg := strings.Cut(text, "=")
+		r := &rule{name: name, arg: arg}
+		switch name {
+		case "required", "omitempty":
+			if hasArg {
+				return nil, fmt.Errorf("bad rule %q", text)
+			}
+		case "min", "max":
+			limit, err := strconv.ParseFloat(arg, 64)
+			if err != nil {
+				return nil, fmt.Errorf("bad rule %q", text)
+			}
+			r.limit = limit
+		case "pattern":
+			re, err := regexp.Compile(arg)
+			if err != nil {
+				return nil, fmt.Errorf("bad rule %q: %v", text, err)
+			}
+			r.re = re
+		case "enum":
+			if arg == "" {
+				return nil, fmt.Errorf("bad rule %q", text)
+			}
+			r.enum = strings.Split(arg, "|")
+		default:
+			return nil, fmt.Errorf("unknown rule %q", text)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// parseRules parses the validate tags of the fields reachable from the args
+// of the method, so the calls don't parse them and malformed tags are
+// reported at registration.
+func (m *RpcServiceMethod) parseRules() error {
+	m.rules = make(map[string][]*rule)
+	types := m.paramTypes
+	if types == nil {
+		types = []reflect.Type{m.argsType}
+	}
+	seen := make(map[reflect.Type]bool)
+	for _, t := range types {
+		if err := parseTags(m.rules, t, seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseTags adds the rules of the validate tags of the fields reachable from
+// the type, keyed by the tag.
+func parseTags(rules map[string][]*rule, t reflect.Type, seen map[reflect.Type]bool) error {
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice || t.Kind() == reflect.Array || t.Kind() == reflect.Map {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || seen[t] {
+		return nil
+	}
+	seen[t] = true
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if _, _, ok := jsonField(field); !ok || field.PkgPath != "" {
+			continue
+		}
+		if tag := field.Tag.Get("validate"); tag != "" {
+			if _, ok := rules[tag]; !ok {
+				parsed, err := parseTag(tag)
+				if err != nil {
+					return fmt.Errorf("validate tag of %s.%s: %v", t, field.Name, err)
+				}
+				rules[tag] = parsed
+			}
+		}
+		if err := parseTags(rules, field.Type, seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// measure returns the number, or the length of the value.
+func measure(v reflect.Value) (float64, bool) {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), false
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(v.Uint()), false
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), false
+	case reflect.String:
+		return float64(len([]rune(v.String()))), true
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return float64(v.Len()), true
+	}
+	return 0, false
+}
+
+// ----------------------------------------------------------------------------
+// Schema validation
+// ----------------------------------------------------------------------------
+
+// compilePatterns adds the compiled patterns of the schema and of the nested
+// schemas, keyed by the pattern.
+func (s *Schema) compilePatterns(patterns map[string]*regexp.Regexp) error {
+	if s.Pattern != "" && patterns[s.Pattern] == nil {
+		re, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("rpc: bad schema pattern %q: %v", s.Pattern, err)
+		}
+		patterns[s.Pattern] = re
+	}
+	nested := []*Schema{s.Items, s.AdditionalProperties}
+	for _, property := range s.Properties {
+		nested = append(nested, property)
+	}
+	for _, n := range nested {
+		if n != nil {
+			if err := n.compilePatterns(patterns); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// validate checks a value decoded from JSON against the schema, with the
+// patterns made by compilePatterns.
+func (s *Schema) validate(violations []*Violation, patterns map[string]*regexp.Regexp, path string, value interface{}) []*Violation {
+	if s.Type != "" && !hasJSONType(value, s.Type) {
+		return append(violations, &Violation{Field: path, Message: "must be " + s.Type})
+	}
+	if len(s.Enum) > 0 {
+		found := false
+		for _, e := range s.Enum {
+			if reflect.DeepEqual(normalizeJSON(e), value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			violations = append(violations, &Violation{Field: path, Message: fmt.Sprintf("must be one of %v", s.Enum)})
+		}
+	}
+	switch value := value.(type) {
+	case float64:
+		if s.Minimum != nil && value < *s.Minimum {
+			violations = append(violations, &Violation{Field: path, Message: fmt.Sprintf("must be at least %v", *s.Minimum)})
+		}
+		if s.Maximum != nil && value > *s.Maximum {
+			violations = append(violations, &Violation{Field: path, Message: fmt.Sprintf("must be at most %v", *s.Maximum)})
+		}
+	case string:
+		length := len([]rune(value))
+		if s.MinLength != nil && length < *s.MinLength {
+			violations = append(violations, &Violation{Field: path, Message: fmt.Sprintf("length must be at least %d", *s.MinLength)})
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			violations = append(violations, &Violation{Field: path, Message: fmt.Sprintf("length must be at most %d", *s.MaxLength)})
+		}
+		if s.Pattern != "" {
+			if re := patterns[s.Pattern]; re != nil && !re.MatchString(value) {
+				violations = append(violations, &Violation{Field: path, Message: "must match " + s.Pattern})
+			}
+		}
+	case []interface{}:
+		if s.MinItems != nil && len(value) < *s.MinItems {
+			violations = append(violations, &Violation{Field: path, Message: fmt.Sprintf("length must be at least %d", *s.MinItems)})
+		}
+		if s.MaxItems != nil && len(value) > *s.MaxItems {
+			violations = append(violations, &Violation{Field: path, Message: fmt.Sprintf("length must be at most %d", *s.MaxItems)})
+		}
+		if s.Items != nil {
+			for i, item := range value {
+				violations = s.Items.validate(violations, patterns, fmt.Sprintf("%s[%d]", path, i), item)
+			}
+		}
+	case map[string]interface{}:
+		if s.MinProperties != nil && len(value) < *s.MinProperties {
+			violations = append(violations, &Violation{Field: path, Message: fmt.Sprintf("length must be at least %d", *s.MinProperties)})
+		}
+		if s.MaxProperties != nil && len(value) > *s.MaxProperties {
+			violations = append(violations, &Violation{Field: path, Message: fmt.Sprintf("length must be at most %d", *s.MaxProperties)})
+		}
+		for _, name := range s.Required {
+			if value[name] == nil {
+				violations = append(violations, &Violation{Field: joinPath(path, name), Message: "required"})
+			}
+		}
+		for name, item := range value {
+			if item == nil {
+				continue
+			}
+			if property := s.Properties[name]; property != nil {
+				violations = property.validate(violations, patterns, joinPath(path, name), item)
+			} else if s.AdditionalProperties != nil {
+				violations = s.AdditionalProperties.validate(violations, patterns, joinPath(path, name), item)
+			}
+		}
+	}
+	return violations
+}
+
+// hasJSONType returns true if the value decoded from JSON has the type.
+func hasJSONType(value interface{}, jsonType string) bool {
+	switch value := value.(type) {
+	case nil:
+		return jsonType == "null"
+	case bool:
+		return jsonType == "boolean"
+	case float64:
+		return jsonType == "number" || jsonType == "integer" && value == float64(int64(value))
+	case string:
+		return jsonType == "string"
+	case []interface{}:
+		return jsonType == "array"
+	case map[string]interface{}:
+		return jsonType == "object"
+	}
+	return false
+}
+
+// normalizeJSON converts the value to the form decoded from JSON.
+func normalizeJSON(value interface{}) interface{} {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return value
+	}
+	var normalized interface{}
+	if err := json.Unmarshal(data, &normalized); err != nil {
+		return value
+	}
+	return normalized
+}
+
+func joinPath(path string, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func hasRule(rules []*rule, name string) bool {
+	for _, r := range rules {
+		if r.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func limitWord(name string) string {
+	if name == "min" {
+		return "at least"
+	}
+	return "at most"
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}